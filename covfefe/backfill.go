@@ -0,0 +1,80 @@
+package covfefe
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backfillBatch is how many pending media BackfillMedia reads at a time.
+const backfillBatch = 100
+
+// BackfillMedia downloads the media recorded in PendingMedia while
+// WithRecordMediaOnly was enabled, in batches, until there are none left or ctx
+// is done. Downloads run concurrently and are rate limited like any other, see
+// WithMediaConcurrency and WithRateLimit.
+//
+// Every attempted download is removed from PendingMedia as soon as it's done,
+// which is the checkpoint: after a crash or cancellation, BackfillMedia resumes
+// from the remaining ones. Failed downloads are recorded in MediaErrors, to be
+// retried at the next Run, and not attempted again here. Progress is logged
+// after every batch. If ctx is done, the downloads that were not attempted are
+// left pending and ctx.Err() is returned. BackfillMedia must not be called
+// while Run is running.
+func (c *Covfefe) BackfillMedia(ctx context.Context) error {
+	total, err := c.countPendingMedia()
+	if err != nil {
+		return err
+	}
+	c.log.WithField("pending", total).Info("Backfilling pending media")
+
+	var mu sync.Mutex
+	var done, failed int64
+	var firstErr error
+	for ctx.Err() == nil && firstErr == nil {
+		batch, err := c.pendingMedia(backfillBatch)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, d := range batch {
+			wg.Add(1)
+			go func(d mediaDownload) {
+				defer wg.Done()
+				derr := c.downloadMedia(ctx, d.tweet, d.media, d.url)
+				if derr != nil && ctx.Err() != nil {
+					return // abandoned or interrupted, left for the next backfill
+				}
+				err := c.deletePendingMedia(d)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					c.log.WithError(err).WithField("media", d.media).Error("Failed to delete pending media")
+					firstErr = firstError(firstErr, err)
+				} else if derr != nil {
+					failed++
+				} else {
+					done++
+				}
+			}(d)
+		}
+		wg.Wait()
+
+		c.log.WithFields(logrus.Fields{
+			"downloaded": done, "failed": failed, "remaining": total - done - failed,
+		}).Info("Backfill progress")
+	}
+
+	c.log.WithFields(logrus.Fields{
+		"downloaded": done, "failed": failed,
+	}).Info("Finished backfilling pending media")
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
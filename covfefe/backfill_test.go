@@ -0,0 +1,19 @@
+package covfefe
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBackfillMediaContext(t *testing.T) {
+	c := openTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.BackfillMedia(ctx); err != context.Canceled {
+		t.Errorf("BackfillMedia with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+	// Later downloads and crawls must not inherit the backfill's context.
+	if err := c.ctx.Err(); err != nil {
+		t.Errorf("context of the archive is done after BackfillMedia: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package covfefe
+
+import (
+	"fmt"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fastjson"
+)
+
+// cardImageName is the name under which the image of a link preview card is
+// stored. Like profile images, they are keyed by hash.
+func cardImageName(tweet int64, hash, ext string) string {
+	return fmt.Sprintf("card-%d-%s.%s", tweet, hash[:16], ext)
+}
+
+// cardImageKeys are the binding values of a summary_large_image card that hold
+// its image, from the largest.
+var cardImageKeys = []string{
+	"summary_photo_image_original", "photo_image_full_size_original", "thumbnail_image_original",
+	"summary_photo_image_large", "photo_image_full_size_large", "thumbnail_image_large",
+}
+
+// cardImageURL returns the URL of the image of a summary_large_image card, or
+// an empty string if card is not one or has no image.
+func cardImageURL(card *fastjson.Value) string {
+	if string(card.GetStringBytes("name")) != "summary_large_image" {
+		return ""
+	}
+	for _, key := range cardImageKeys {
+		if u := card.GetStringBytes("binding_values", key, "image_value", "url"); len(u) != 0 {
+			return string(u)
+		}
+	}
+	return ""
+}
+
+// processCardImage downloads the image of the link preview card of tweet in
+// the background, if enabled by WithCardImages. Card images can be hosted
+// anywhere, not only on twimg.com.
+func (c *Covfefe) processCardImage(m *Message, tweet *twitter.Tweet) {
+	if !c.cardImages || !c.fetching() {
+		return
+	}
+	if c.skipSensitiveMedia && tweet.PossiblySensitive {
+		return
+	}
+	raw := m.rawTweet(tweet.ID)
+	if raw == nil || !raw.Exists("card") {
+		return
+	}
+	url := cardImageURL(raw.Get("card"))
+	if url == "" {
+		return
+	}
+	c.inBackground(m, func() {
+		c.downloadCardImage(tweet.ID, url, m.id)
+	})
+}
+
+func (c *Covfefe) downloadCardImage(tweet int64, url string, message int64) {
+	log := c.log.WithFields(logrus.Fields{"url": url, "tweet": tweet})
+	if _, loaded := c.downloads.LoadOrStore(url, tweet); loaded {
+		return
+	}
+	defer c.downloads.Delete(url)
+	if ok, err := c.cardImageExists(tweet, url); err != nil {
+		log.WithError(err).Error("Failed to look up card image")
+		return
+	} else if ok {
+		return
+	}
+
+	select {
+	case c.mediaSem <- struct{}{}:
+		defer func() { <-c.mediaSem }()
+	case <-c.ctx.Done():
+		log.Warning("Abandoned card image download")
+		return
+	}
+	f, contentType, err := c.download(c.ctx, url)
+	if err != nil {
+		log.WithError(err).Error("Failed to download card image")
+		c.metrics.mediaFailed.inc()
+		return
+	}
+	defer removeTemp(f)
+	mf, err := inspectMedia(f, contentType)
+	if err != nil {
+		log.WithError(err).Error("Failed to save card image")
+		c.metrics.mediaFailed.inc()
+		return
+	}
+	if c.dryRun {
+		log.WithField("hash", mf.hash).WithField("type", mf.mime).
+			WithField("size", mf.size).Info("Dry run: would save card image")
+		return
+	}
+	name := cardImageName(tweet, mf.hash, mf.ext)
+	if err := c.media.Put(name, f); err != nil {
+		log.WithError(err).Error("Failed to save card image")
+		c.metrics.mediaFailed.inc()
+		return
+	}
+	c.metrics.mediaDownloaded.inc()
+	if err := c.insertCardImage(tweet, url, mf.hash, name, message); err != nil {
+		log.WithError(err).Error("Failed to insert card image")
+	}
+}
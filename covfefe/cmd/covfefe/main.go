@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/FiloSottile/mostly-harmless/covfefe"
 	log "github.com/sirupsen/logrus"
 	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
-	// TODO: prometheus
 )
 
 func main() {
@@ -18,6 +26,48 @@ func main() {
 	credsFile := flag.String("creds", "creds.json", "The path of the credentials JSON")
 	syslogFlag := flag.Bool("syslog", false, "Also log to syslog")
 	debugFlag := flag.Bool("debug", false, "Enable debug logging")
+	mediaOverwrite := flag.String("media-overwrite", "skip", "Whether to replace existing media files: skip, always, or smaller")
+	s3Bucket := flag.String("s3-bucket", "", "Store media files in this S3 bucket instead of -media")
+	s3Prefix := flag.String("s3-prefix", "", "The key prefix for media files in the S3 bucket")
+	s3Region := flag.String("s3-region", "us-east-1", "The region of the S3 bucket")
+	mediaRetries := flag.Int("media-retries", 3, "How many times to retry failed media downloads")
+	threadDepth := flag.Int("thread-depth", 10, "How many reply parents to fetch from the API")
+	quoteDepth := flag.Int("quote-depth", 0, "How many levels of non-embedded quoted tweets to fetch from the API")
+	maxNesting := flag.Int("max-nesting", 8, "How deeply retweets and quotes can be nested in a message")
+	resolveURLs := flag.Bool("resolve-urls", false, "Follow links in tweets to record their destination")
+	maxMediaBytes := flag.Int64("max-media-bytes", 1<<30, "Maximum size of a media file, 0 for no limit")
+	mediaConcurrency := flag.Int("media-concurrency", 8, "How many media files to download at the same time")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics at /metrics and a health check at /healthz on this address")
+	healthWindow := flag.Duration("health-window", 10*time.Minute, "How long /healthz tolerates no new messages")
+	dryRun := flag.Bool("dry-run", false, "Process messages without writing to the DB or media store")
+	userAgent := flag.String("user-agent", "", "The User-Agent of media downloads, instead of the default")
+	requestTimeout := flag.Duration("request-timeout", time.Minute, "How long a single media download request can take")
+	directMessages := flag.Bool("direct-messages", false, "Also archive the private direct messages of the accounts")
+	recordMediaOnly := flag.Bool("record-media-only", false, "Record media to download later with -download-pending, instead of downloading it")
+	downloadPending := flag.Bool("download-pending", false, "Download the media recorded with -record-media-only, and exit")
+	busyTimeout := flag.Duration("busy-timeout", 10*time.Second, "How long to wait for a locked database before failing")
+	poolSize := flag.Int("db-connections", 5, "How many database connections to keep open")
+	shardMedia := flag.Bool("shard-media", false, "Store media files in folders named after the first digits of their ID")
+	dateMedia := flag.Bool("date-media", false, "Store media files in year/month folders of when the tweet was posted")
+	linkProxy := flag.String("link-proxy", "", "Resolve links to hosts other than Twitter's through this proxy URL")
+	purgeMedia := flag.Bool("purge-deleted-media", false, "Remove the media files of deleted tweets")
+	compressMessages := flag.Bool("compress-messages", false, "Store new raw messages gzip compressed")
+	stripMetadata := flag.Bool("strip-metadata", false, "Remove EXIF and other metadata from downloaded images")
+	skipSensitive := flag.Bool("skip-sensitive-media", false, "Don't download the media of tweets marked as possibly sensitive")
+	tweetCache := flag.Int("tweet-cache", 1<<16, "How many stored tweet IDs to remember, 0 to disable")
+	trackEngagement := flag.Bool("track-engagement", false, "Record the counts of tweets every time they are seen")
+	skipRetweets := flag.Bool("skip-retweet-wrappers", false, "Store only the original of retweets, and the retweet edge")
+	droppedLogInterval := flag.Duration("dropped-log-interval", 10*time.Minute, "How often to log counts of dropped protected messages, 0 to disable")
+	cardImages := flag.Bool("card-images", false, "Download the images of link preview cards, which can be on any host")
+	onConflict := flag.String("on-conflict", "ignore", "What to do with tweets that are already stored: ignore, update, or upgrade compact ones")
+	storeTweetJSON := flag.Bool("store-tweet-json", false, "Also store the raw JSON of each tweet on its own, for querying")
+	waybackRate := flag.Float64("wayback-rate", 0, "Submit resolved links to the Wayback Machine, at most this many per second (0 disables, needs -resolve-urls)")
+	excludeUsers := flag.String("exclude-users", "", "Comma-separated user IDs to never archive, not even in raw messages they author")
+	dedupTweets := flag.Bool("dedup-tweets", false, "Store tweets received by multiple accounts only once, ignoring per-account fields")
+	sampleRate := flag.Float64("sample-rate", 1, "The fraction of tweets to store, picked consistently by ID")
+	allowProtected := flag.String("allow-protected", "", "Comma-separated IDs of protected users to archive anyway, if the accounts are authorized to see them")
+	allowFollowed := flag.Bool("allow-followed-protected", false, "Archive protected users followed by the account receiving their content")
+	rateLimit := flag.Float64("rate-limit", 10, "Maximum download requests per second to each host")
 	flag.Parse()
 
 	if *debugFlag {
@@ -40,7 +90,140 @@ func main() {
 		log.WithError(err).Fatal("Failed to parse credentials file")
 	}
 
-	if err := covfefe.Run(*dbFile, *mediaPath, creds); err != nil {
+	overwrite, ok := map[string]covfefe.OverwritePolicy{
+		"skip": covfefe.SkipExisting, "always": covfefe.OverwriteExisting, "smaller": covfefe.OverwriteSmaller,
+	}[*mediaOverwrite]
+	if !ok {
+		log.WithField("value", *mediaOverwrite).Fatal("Invalid -media-overwrite policy")
+	}
+
+	conflicts, ok := map[string]covfefe.ConflictStrategy{
+		"ignore": covfefe.IgnoreConflicts, "update": covfefe.UpdateConflicts, "upgrade": covfefe.UpgradeCompact,
+	}[*onConflict]
+	if !ok {
+		log.WithField("value", *onConflict).Fatal("Invalid -on-conflict strategy")
+	}
+
+	excluded := parseIDs("exclude-users", *excludeUsers)
+	allowed := parseIDs("allow-protected", *allowProtected)
+
+	opts := []covfefe.Option{
+		covfefe.WithMediaStore(&covfefe.FileStore{Dir: *mediaPath, Overwrite: overwrite}),
+		covfefe.WithMediaRetries(*mediaRetries),
+		covfefe.WithMediaConcurrency(*mediaConcurrency),
+		covfefe.WithMaxMediaBytes(*maxMediaBytes),
+		covfefe.WithRateLimit(*rateLimit),
+		covfefe.WithMaxThreadDepth(*threadDepth),
+		covfefe.WithMaxQuoteDepth(*quoteDepth),
+		covfefe.WithMaxNesting(*maxNesting),
+		covfefe.WithResolveURLs(*resolveURLs),
+		covfefe.WithWayback(*waybackRate),
+		covfefe.WithCardImages(*cardImages),
+		covfefe.WithDryRun(*dryRun),
+		covfefe.WithRequestTimeout(*requestTimeout),
+		covfefe.WithDirectMessages(*directMessages),
+		covfefe.WithRecordMediaOnly(*recordMediaOnly),
+		covfefe.WithBusyTimeout(*busyTimeout),
+		covfefe.WithPoolSize(*poolSize),
+		covfefe.WithHealthWindow(*healthWindow),
+		covfefe.WithPurgeMediaOnDeletion(*purgeMedia),
+		covfefe.WithCompressMessages(*compressMessages),
+		covfefe.WithDedupTweets(*dedupTweets),
+		covfefe.WithStoreTweetJSON(*storeTweetJSON),
+		covfefe.WithStripMetadata(*stripMetadata),
+		covfefe.WithSkipSensitiveMedia(*skipSensitive),
+		covfefe.WithTweetCacheSize(*tweetCache),
+		covfefe.WithTrackEngagement(*trackEngagement),
+		covfefe.WithSkipRetweetWrappers(*skipRetweets),
+		covfefe.WithExcludedUsers(excluded...),
+		covfefe.WithAllowedProtected(allowed...),
+		covfefe.WithAllowFollowedProtected(*allowFollowed),
+		covfefe.WithSampleRate(*sampleRate),
+		covfefe.WithDroppedLogInterval(*droppedLogInterval),
+		covfefe.WithConflictStrategy(conflicts),
+	}
+	if *shardMedia && *dateMedia {
+		log.Fatal("Only one of -shard-media and -date-media can be used")
+	}
+	if *shardMedia {
+		opts = append(opts, covfefe.WithMediaNamer(covfefe.ShardedMediaName))
+	}
+	if *dateMedia {
+		opts = append(opts, covfefe.WithDatedMediaNamer(covfefe.DatedMediaName))
+	}
+	if *userAgent != "" {
+		opts = append(opts, covfefe.WithUserAgent(*userAgent))
+	}
+	if *linkProxy != "" {
+		proxy, err := url.Parse(*linkProxy)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -link-proxy URL")
+		}
+		proxied := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+		opts = append(opts, covfefe.WithHTTPClientFunc(func(host string) *http.Client {
+			if host == "twimg.com" || strings.HasSuffix(host, ".twimg.com") {
+				return nil
+			}
+			return proxied
+		}))
+	}
+	if *s3Bucket != "" {
+		opts = append(opts, covfefe.WithMediaStore(&covfefe.S3Store{
+			Bucket: *s3Bucket, Prefix: *s3Prefix, Region: *s3Region,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}))
+	}
+
+	c, err := covfefe.Open(*dbFile, opts...)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open archive")
+	}
+	defer c.Close()
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", c.MetricsHandler())
+		mux.Handle("/healthz", c.HealthHandler())
+		go func() {
+			log.WithError(http.ListenAndServe(*metricsAddr, mux)).Error("Metrics server failed")
+		}()
+	}
+
+	if *downloadPending {
+		// Interrupting leaves the remaining media pending, to resume later.
+		ctx, cancel := context.WithCancel(context.Background())
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			log.WithField("signal", <-sigs).Info("Received signal, stopping...")
+			cancel()
+		}()
+		if err := c.BackfillMedia(ctx); err != nil {
+			log.WithError(err).Fatal("Failed to download pending media")
+		}
+		return
+	}
+
+	if err := c.Run(creds); err != nil {
 		log.WithError(err).Fatal("Failed to run fetcher")
 	}
 }
+
+// parseIDs parses the comma-separated user IDs of the flag name, exiting if any
+// is invalid.
+func parseIDs(name, value string) []int64 {
+	if value == "" {
+		return nil
+	}
+	var ids []int64
+	for _, s := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			log.WithField("value", s).Fatalf("Invalid -%s ID", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
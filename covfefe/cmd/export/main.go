@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/FiloSottile/mostly-harmless/covfefe"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	dbFile := flag.String("db", "twitter.db", "The path of the SQLite DB")
+	account := flag.Int64("account", 0, "Only export tweets observed by this account ID")
+	since := flag.String("since", "", "Only export tweets created on or after this date (YYYY-MM-DD)")
+	until := flag.String("until", "", "Only export tweets created before this date (YYYY-MM-DD)")
+	deleted := flag.Bool("deleted", false, "Also export deleted tweets")
+	follows := flag.Bool("follows", false, "Export the follow graph as CSV instead of tweets")
+	flag.Parse()
+
+	filter := covfefe.ExportFilter{
+		Account:        *account,
+		IncludeDeleted: *deleted,
+	}
+	if *since != "" {
+		t, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -since date")
+		}
+		filter.Since = t
+	}
+	if *until != "" {
+		t, err := time.Parse("2006-01-02", *until)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid -until date")
+		}
+		filter.Until = t
+	}
+
+	c, err := covfefe.Open(*dbFile)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open archive")
+	}
+	defer c.Close()
+
+	if *follows {
+		if err := c.ExportFollows(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Failed to export follows")
+		}
+		return
+	}
+	if err := c.ExportTweets(os.Stdout, filter); err != nil {
+		log.WithError(err).Fatal("Failed to export tweets")
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"os"
+	"runtime"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/FiloSottile/mostly-harmless/covfefe"
 	log "github.com/sirupsen/logrus"
@@ -13,6 +15,9 @@ func main() {
 	dbFile := flag.String("db", "twitter.db", "The path of the SQLite DB")
 	debugFlag := flag.Bool("debug", false, "Enable debug logging")
 	pprofFlag := flag.Bool("pprof", false, "Write a CPU profile")
+	restartFlag := flag.Bool("restart-rescan", false, "Start over instead of resuming an interrupted rescan")
+	concurrency := flag.Int("concurrency", runtime.NumCPU(), "How many messages to decode at the same time")
+	rebuild := flag.String("rebuild", "", "Instead of a rescan, rebuild these comma-separated derived tables, or \"all\"")
 	flag.Parse()
 
 	if *debugFlag {
@@ -31,7 +36,23 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if err := covfefe.Rescan(*dbFile); err != nil {
+	if *rebuild != "" {
+		c, err := covfefe.Open(*dbFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open archive")
+		}
+		defer c.Close()
+		var tables []string
+		if *rebuild != "all" {
+			tables = strings.Split(*rebuild, ",")
+		}
+		if err := c.RebuildIndexes(tables...); err != nil {
+			log.WithError(err).Fatal("Failed to rebuild tables")
+		}
+		return
+	}
+
+	if err := covfefe.Rescan(*dbFile, *restartFlag, *concurrency); err != nil {
 		log.WithError(err).Fatal("Failed to run rescan")
 	}
 }
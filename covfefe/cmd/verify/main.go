@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/FiloSottile/mostly-harmless/covfefe"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	dbFile := flag.String("db", "twitter.db", "The path of the SQLite DB")
+	mediaPath := flag.String("media", "twitter-media", "The folder media files are stored in")
+	s3Bucket := flag.String("s3-bucket", "", "Check media files in this S3 bucket instead of -media")
+	s3Prefix := flag.String("s3-prefix", "", "The key prefix for media files in the S3 bucket")
+	s3Region := flag.String("s3-region", "us-east-1", "The region of the S3 bucket")
+	flag.Parse()
+
+	var store covfefe.MediaStore = &covfefe.FileStore{Dir: *mediaPath}
+	if *s3Bucket != "" {
+		store = &covfefe.S3Store{
+			Bucket: *s3Bucket, Prefix: *s3Prefix, Region: *s3Region,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+
+	c, err := covfefe.Open(*dbFile, covfefe.WithMediaStore(store))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open archive")
+	}
+	defer c.Close()
+
+	report, err := c.Verify()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to verify archive")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		log.WithError(err).Fatal("Failed to write report")
+	}
+	if !report.OK() {
+		c.Close()
+		os.Exit(1)
+	}
+}
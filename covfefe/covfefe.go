@@ -2,19 +2,23 @@ package covfefe
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	"github.com/golang/groupcache/lru"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 type Credentials struct {
@@ -29,54 +33,654 @@ type Account struct {
 }
 
 type Covfefe struct {
+	lastHandled int64 // UnixNano, accessed atomically, see markHandled
+
+	ctx        context.Context // cancelled when background work should stop
 	withConn   func(f func(conn *sqlite.Conn) error) error
+	close      func() error
+	metrics    *metrics
+	log        logrus.FieldLogger
 	wg         sync.WaitGroup
+	downloads  sync.Map      // URL -> tweet ID of in-flight media downloads
+	mediaSem   chan struct{} // limits concurrent media downloads
+	limiter    *hostLimiter  // shared by all downloads
+	breaker    *hostBreaker  // shared by all media downloads
+	wayback    *hostLimiter  // nil if disabled, see WithWayback
 	httpClient *http.Client
+	clientFor  func(host string) *http.Client // optional, see WithHTTPClientFunc
+	store      store
 	msgIDs     *lru.Cache
-	mediaPath  string
+	tweetIDs   *lru.Cache // stored tweets, nil if disabled, see WithTweetCacheSize
+	media      MediaStore
+	mediaNamer func(id int64, created time.Time, ext string) string
+	decoder    Decoder
 	rescan     bool // TODO: get rid of this field
+	fetch      bool
+
+	// apiClients maps account IDs to their authenticated *http.Client.
+	apiClients sync.Map
+	crawled    *lru.Cache
+	apiBudget  apiBudget // shared by all REST API fetches
+
+	// crawlQueue holds the crawls waiting to be fetched by runCrawler, which
+	// passes the fetched tweets to HandleChan through crawledMessages.
+	crawlQueue      chan crawlRequest
+	crawledMessages chan *Message
+
+	mediaRetries         int
+	maxMediaBytes        int64
+	mediaConcurrency     int
+	maxThreadDepth       int
+	maxQuoteDepth        int
+	maxNesting           int
+	resolveURLs          bool
+	waybackRate          float64
+	cardImages           bool
+	dryRun               bool
+	directMessages       bool
+	recordMediaOnly      bool
+	compressMessages     bool
+	dedupTweets          bool
+	storeTweetJSON       bool
+	stripMetadata        bool
+	mediaProcessors      []MediaProcessor
+	skipSensitiveMedia   bool
+	tweetCacheSize       int
+	trackEngagement      bool
+	tweetConflicts       ConflictStrategy
+	skipRetweetWrappers  bool
+	excludedUsers        map[int64]bool
+	allowedProtected     map[int64]bool
+	allowFollowed        bool
+	sampleRate           float64
+	purgeMediaOnDeletion bool
+	rateLimit            float64
+	userAgent            string
+	requestTimeout       time.Duration
+	busyTimeout          time.Duration
+	poolSize             int
+	onTweet              func(tweet *twitter.Tweet, messageID int64)
+	publisher            Publisher
+	publishTopic         string
+	publishQueue         chan publication
+	publishCancel        context.CancelFunc
+	publishDone          chan struct{}
+	healthWindow         time.Duration
+	droppedLogInterval   time.Duration
 }
 
-func Run(dbPath, mediaPath string, creds *Credentials) error {
-	db, err := sqlite.Open("file:"+dbPath, 0, 5)
-	if err != nil {
-		return errors.Wrap(err, "failed to open database")
+// An Option configures optional behavior of a Covfefe instance.
+type Option func(*Covfefe)
+
+// WithMediaRetries sets how many times a failed media download is retried
+// before giving up. The default is 3.
+func WithMediaRetries(n int) Option {
+	return func(c *Covfefe) { c.mediaRetries = n }
+}
+
+// WithMaxMediaBytes sets the maximum size of a media file. Larger downloads are
+// aborted and recorded as failed. Zero or less disables the limit. The default
+// is 1 GiB.
+func WithMaxMediaBytes(n int64) Option {
+	return func(c *Covfefe) { c.maxMediaBytes = n }
+}
+
+// WithMediaConcurrency sets how many media files can be downloaded at the same
+// time. The default is 8.
+func WithMediaConcurrency(n int) Option {
+	return func(c *Covfefe) { c.mediaConcurrency = n }
+}
+
+// WithRateLimit sets how many download requests per second can be made to
+// each host. Zero or less disables rate limiting. The default is 10.
+func WithRateLimit(rps float64) Option {
+	return func(c *Covfefe) { c.rateLimit = rps }
+}
+
+// WithUserAgent sets the User-Agent header of media downloads and URL
+// resolutions. The default identifies covfefe and links to its source.
+func WithUserAgent(ua string) Option {
+	return func(c *Covfefe) { c.userAgent = ua }
+}
+
+// WithRequestTimeout sets how long a single download request can take,
+// including reading the response. Failed requests might be retried, within an
+// overall limit of five minutes per file. Zero or less disables the timeout.
+// The default is one minute.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *Covfefe) { c.requestTimeout = d }
+}
+
+// WithHTTPClientFunc sets a function that picks the client used to fetch media,
+// profile images and links, based on the host of the URL, for example to route
+// some of them through a proxy. If f returns nil, or by default, a plain client
+// is used. Timeouts are applied by covfefe, see WithRequestTimeout.
+func WithHTTPClientFunc(f func(host string) *http.Client) Option {
+	return func(c *Covfefe) { c.clientFor = f }
+}
+
+// WithFetching sets whether media, profile images, card images and links are
+// downloaded, and replies and quotes crawled, in the background. Disabling it
+// archives only what's in the messages themselves. The default is true.
+func WithFetching(enabled bool) Option {
+	return func(c *Covfefe) { c.fetch = enabled }
+}
+
+// WithMaxThreadDepth sets how many reply parents are fetched from the API
+// when archiving a reply. Zero disables thread crawling. The default is 10.
+func WithMaxThreadDepth(n int) Option {
+	return func(c *Covfefe) { c.maxThreadDepth = n }
+}
+
+// WithMaxQuoteDepth sets how many levels of quoted tweets are fetched from the
+// API when archiving a quote tweet that doesn't embed the quoted one. Tweets
+// fetched this way or by thread crawling count towards both depths. The quote
+// itself is recorded either way. The default is zero, which disables it.
+func WithMaxQuoteDepth(n int) Option {
+	return func(c *Covfefe) { c.maxQuoteDepth = n }
+}
+
+// WithMaxNesting sets how deeply tweets can be nested in a message, like a
+// retweet of a quote, before the inner ones are dropped. It bounds the
+// recursion of processing a single message, independently of crawling. The
+// default is 8, which is more than the API ever nests.
+func WithMaxNesting(n int) Option {
+	return func(c *Covfefe) { c.maxNesting = n }
+}
+
+// WithResolveURLs enables following the redirects of links in tweets, to
+// record their final destination. Expanded t.co links are always recorded.
+func WithResolveURLs(enabled bool) Option {
+	return func(c *Covfefe) { c.resolveURLs = enabled }
+}
+
+// WithWayback enables submitting the final destination of resolved links to
+// the Save Page Now endpoint of the Internet Archive, at most rate times per
+// second, and recording the resulting snapshot URL in URLs.wayback. It needs
+// WithResolveURLs. The default is zero, which disables it.
+func WithWayback(rate float64) Option {
+	return func(c *Covfefe) { c.waybackRate = rate }
+}
+
+// WithCardImages enables downloading the image of summary_large_image link
+// preview cards, which is stored in the MediaStore and recorded in CardImages.
+// Unlike tweet media, these images can be hosted by third parties, so like
+// WithResolveURLs it makes requests to arbitrary hosts.
+func WithCardImages(enabled bool) Option {
+	return func(c *Covfefe) { c.cardImages = enabled }
+}
+
+// WithDryRun enables a mode where messages are fetched and processed as usual,
+// but nothing is written to the database or the MediaStore. What would have
+// been written is logged instead. The database schema is still created if
+// missing.
+func WithDryRun(enabled bool) Option {
+	return func(c *Covfefe) { c.dryRun = enabled }
+}
+
+// WithDirectMessages enables archiving the direct messages of the accounts.
+// They are private, so they are dropped by default.
+func WithDirectMessages(enabled bool) Option {
+	return func(c *Covfefe) { c.directMessages = enabled }
+}
+
+// WithCompressMessages enables storing new raw messages gzip compressed, which
+// usually makes them a few times smaller. Messages are decompressed
+// transparently when read back, and databases can mix compressed and
+// uncompressed messages, so the option can be changed at any time.
+func WithCompressMessages(enabled bool) Option {
+	return func(c *Covfefe) { c.compressMessages = enabled }
+}
+
+// WithDedupTweets enables storing a tweet received by multiple accounts as a
+// single message, recording all the accounts that observed it. Messages are
+// normally only deduplicated if they are identical, but each account gets
+// fields like favorited and following from its own point of view. With this
+// option, tweets are compared without those, so only the first copy is stored.
+// Copies with different counts, such as those fetched at different times, are
+// still stored separately. The default is false.
+func WithDedupTweets(enabled bool) Option {
+	return func(c *Covfefe) { c.dedupTweets = enabled }
+}
+
+// WithStoreTweetJSON enables storing the raw JSON object of each new tweet in
+// TweetJSON, besides the message it came in, so that it can be read or queried
+// with the SQLite JSON functions without extracting it from the envelope. They
+// are never compressed. See also RawTweet.
+func WithStoreTweetJSON(enabled bool) Option {
+	return func(c *Covfefe) { c.storeTweetJSON = enabled }
+}
+
+// WithStripMetadata enables removing the metadata of downloaded JPEG and PNG
+// images before storing them, like EXIF with its GPS coordinates and camera
+// details, XMP, IPTC and comments. Twitter already strips it from uploaded
+// images, but not necessarily from other media. Since the EXIF orientation is
+// removed too, some photos might be displayed rotated. Videos and other
+// formats are stored unchanged. The default is false.
+func WithStripMetadata(enabled bool) Option {
+	return func(c *Covfefe) { c.stripMetadata = enabled }
+}
+
+// WithMediaProcessors adds MediaProcessors that run in order on each media file
+// of a tweet before it's stored, after WithStripMetadata, each on the output of
+// the previous one. The hash, size and dimensions recorded in Media are of the
+// final output. If a processor fails, the file is not stored, and the download
+// is recorded as failed. Profile and card images are stored unchanged.
+func WithMediaProcessors(ps ...MediaProcessor) Option {
+	return func(c *Covfefe) { c.mediaProcessors = append(c.mediaProcessors, ps...) }
+}
+
+// WithSkipSensitiveMedia disables downloading the media of tweets marked as
+// possibly sensitive. The tweets themselves are still archived. The default is
+// false.
+func WithSkipSensitiveMedia(enabled bool) Option {
+	return func(c *Covfefe) { c.skipSensitiveMedia = enabled }
+}
+
+// WithTweetCacheSize sets how many IDs of stored tweets are remembered, so that
+// tweets seen again, like popular retweeted ones, are recognized without a
+// database query. Zero disables the cache. The default is 65536.
+func WithTweetCacheSize(n int) Option {
+	return func(c *Covfefe) { c.tweetCacheSize = n }
+}
+
+// WithTrackEngagement enables recording the favorite, retweet, reply and quote
+// counts of a tweet every time it's seen, not just the first, to follow how
+// they grow. The default is false.
+func WithTrackEngagement(enabled bool) Option {
+	return func(c *Covfefe) { c.trackEngagement = enabled }
+}
+
+// A ConflictStrategy decides what happens when a tweet that is already stored
+// is seen again, possibly with different data.
+type ConflictStrategy int
+
+const (
+	// IgnoreConflicts keeps the stored tweet as it was first seen.
+	IgnoreConflicts ConflictStrategy = iota
+	// UpdateConflicts refreshes the text, language, source, sensitive flag
+	// and favorite and retweet counts of the stored tweet, and fills in its
+	// conversation if unknown. The creation time, author and first message
+	// are kept, and Tweets.updated is set to the last message. Compact
+	// tweets are also upgraded, like with UpgradeCompact, but never replace
+	// the text of a full one.
+	UpdateConflicts
+	// UpgradeCompact keeps the stored tweet, unless it's in a compact form,
+	// flagged in Tweets.compact, and the new one isn't. Then the full version
+	// replaces it, including its message, and is processed like a new tweet.
+	UpgradeCompact
+)
+
+// WithConflictStrategy sets what happens to tweets that are already stored.
+// Either way, the derived data of a tweet, like its hashtags and media, is only
+// processed the first time. The default is IgnoreConflicts.
+func WithConflictStrategy(s ConflictStrategy) Option {
+	return func(c *Covfefe) { c.tweetConflicts = s }
+}
+
+// WithSkipRetweetWrappers enables a mode where retweets are not stored as
+// tweets themselves. The original tweet, the retweeter, and the edge between
+// them in Retweets are still recorded. The default is false.
+func WithSkipRetweetWrappers(enabled bool) Option {
+	return func(c *Covfefe) { c.skipRetweetWrappers = enabled }
+}
+
+// WithExcludedUsers sets user IDs that are never archived. Unlike protected
+// users, who are dropped because Twitter restricts their audience, this is a
+// hard exclusion: messages authored by them, and events by or targeting them,
+// are not even stored in Messages, and their tweets and profiles are skipped
+// wherever they appear, including as the retweeted or quoted tweets of
+// others, which are not followed any further. The tweets of others are still
+// stored whole in Messages, embedded content included, and can still record
+// the IDs of the tweets they retweet, quote or reply to. Rescans apply it too,
+// so a Rescan drops the derived data of a newly excluded user, but not the
+// messages that were already stored.
+func WithExcludedUsers(ids ...int64) Option {
+	return func(c *Covfefe) {
+		if c.excludedUsers == nil {
+			c.excludedUsers = make(map[int64]bool)
+		}
+		for _, id := range ids {
+			c.excludedUsers[id] = true
+		}
+	}
+}
+
+// WithAllowedProtected sets protected users whose content is archived anyway,
+// for when the monitored accounts are authorized to see it. Their tweets, and
+// events by or targeting them, are stored like those of public users, instead
+// of being dropped with reason "protected_user". Tweets with a limited audience,
+// like Circle tweets, are still dropped. Rescans apply it too, so removing a
+// user from the list and rescanning drops their derived data, but not the
+// messages that were already stored. By default, all protected users are
+// dropped.
+func WithAllowedProtected(ids ...int64) Option {
+	return func(c *Covfefe) {
+		if c.allowedProtected == nil {
+			c.allowedProtected = make(map[int64]bool)
+		}
+		for _, id := range ids {
+			c.allowedProtected[id] = true
+		}
+	}
+}
+
+// WithAllowFollowedProtected enables archiving the content of protected users
+// that the account receiving the message follows, as if they were allowed with
+// WithAllowedProtected. That's read from the "following" field of the user
+// object, which reflects the receiving account at the time of the message, so
+// users stop being archived once they are unfollowed. It's disabled by default.
+func WithAllowFollowedProtected(enabled bool) Option {
+	return func(c *Covfefe) { c.allowFollowed = enabled }
+}
+
+// WithSampleRate enables storing only a fraction of tweets, between 0 and 1.
+// Whether a tweet is kept depends only on a hash of its ID, so the same tweets
+// are kept across runs, rescans and instances with the same rate, and lowering
+// the rate keeps a subset of what a higher one kept. Retweets and quotes are
+// sampled by the ID of the outer tweet, and events about a tweet, like
+// favorites, are kept only if the tweet would be, or was stored anyway as the
+// original of one of those. Deletions and other messages, like follows, are all
+// kept. The default is 1, which keeps everything.
+func WithSampleRate(rate float64) Option {
+	return func(c *Covfefe) { c.sampleRate = rate }
+}
+
+// WithRecordMediaOnly enables a mode where media files are not downloaded
+// while archiving, but recorded in PendingMedia, to be fetched later with
+// DownloadPendingMedia.
+func WithRecordMediaOnly(enabled bool) Option {
+	return func(c *Covfefe) { c.recordMediaOnly = enabled }
+}
+
+// WithPurgeMediaOnDeletion sets whether the media files of a tweet are removed
+// from the MediaStore when the tweet is deleted, unless they are also attached
+// to other tweets that were not deleted. The MediaStore must support removing
+// files, like FileStore and S3Store do. The default is false.
+func WithPurgeMediaOnDeletion(enabled bool) Option {
+	return func(c *Covfefe) { c.purgeMediaOnDeletion = enabled }
+}
+
+// WithMediaStore sets where downloaded media is stored, instead of the
+// mediaPath folder.
+func WithMediaStore(s MediaStore) Option {
+	return func(c *Covfefe) { c.media = s }
+}
+
+// WithLogger sets the logger used by the instance, for example to route its
+// logs separately from the rest of the application. The default is the
+// standard logrus logger.
+func WithLogger(l logrus.FieldLogger) Option {
+	return func(c *Covfefe) { c.log = l }
+}
+
+// WithBusyTimeout sets how long a database connection waits for a lock held by
+// another connection before failing with "database is locked". The default is
+// 10 seconds.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(c *Covfefe) { c.busyTimeout = d }
+}
+
+// WithPoolSize sets how many database connections are kept open. In WAL mode
+// readers don't block each other or the writer, while writes are serialized by
+// SQLite, so a handful of connections is usually enough. The default is 5.
+func WithPoolSize(n int) Option {
+	return func(c *Covfefe) { c.poolSize = n }
+}
+
+// WithMediaNamer sets the function that picks the name of a media file in the
+// MediaStore, from the media ID and the file extension. The name is a relative,
+// slash-separated path, and folders are created as needed. The default is
+// "<id>.<ext>", see also ShardedMediaName and WithDatedMediaNamer.
+func WithMediaNamer(f func(id int64, ext string) string) Option {
+	return func(c *Covfefe) {
+		c.mediaNamer = func(id int64, _ time.Time, ext string) string { return f(id, ext) }
 	}
-	defer db.Close()
+}
+
+// WithDatedMediaNamer is like WithMediaNamer, but f also gets when the tweet
+// was posted, as encoded in its ID, see DatedMediaName. Files stored under
+// other names are not moved, and are still found through the Media table.
+func WithDatedMediaNamer(f func(id int64, created time.Time, ext string) string) Option {
+	return func(c *Covfefe) { c.mediaNamer = f }
+}
+
+// WithHealthWindow sets how long HealthHandler tolerates not handling any
+// message before reporting the archiver as unhealthy. The default is 10
+// minutes, which is a few polls of the timelines.
+func WithHealthWindow(d time.Duration) Option {
+	return func(c *Covfefe) { c.healthWindow = d }
+}
+
+// WithDroppedLogInterval sets how often Run logs, at Info level, how many
+// messages were dropped as protected since the previous time, by reason. Zero
+// disables it. The default is 10 minutes.
+func WithDroppedLogInterval(d time.Duration) Option {
+	return func(c *Covfefe) { c.droppedLogInterval = d }
+}
+
+// WithOnTweet sets a function called for every new tweet, once the message it
+// was in, and everything derived from it, is committed to the database. f is
+// called synchronously from the goroutine handling the message, and must not
+// block for long. It's not called during rescans.
+func WithOnTweet(f func(tweet *twitter.Tweet, messageID int64)) Option {
+	return func(c *Covfefe) { c.onTweet = f }
+}
+
+// WithPublisher sets a Publisher that every new tweet is sent to, as the JSON
+// object it was received as, once it's committed to the database. Tweets are
+// queued and published in order from a separate goroutine, so a slow consumer
+// doesn't hold up archiving: if the queue fills up, tweets are dropped. Dropped
+// tweets and failures are logged and counted in the metrics, but otherwise
+// ignored. Close waits a few seconds for the queue to drain. Tweets are not
+// published during rescans. By default, there is no publisher.
+func WithPublisher(p Publisher, topic string) Option {
+	return func(c *Covfefe) { c.publisher, c.publishTopic = p, topic }
+}
 
+// WithDecoder sets the Decoder used to understand raw messages, for example to
+// import archives of another tool with HandleRaw. The raw messages are stored
+// as they are, so rescans and Reprocess need the same Decoder. Features that
+// read fields go-twitter doesn't decode, like polls and alt text, expect the
+// format of the Twitter API, and find nothing in other formats. The default is
+// StreamDecoder.
+func WithDecoder(d Decoder) Option {
+	return func(c *Covfefe) { c.decoder = d }
+}
+
+// Open opens the archive database at dbPath, creating it if necessary.
+// dbPath can also be a SQLite "file:" URI, or ":memory:" for a fresh in-memory
+// database, which is shared by the connections of this Covfefe and discarded by
+// Close, and is mostly useful in tests. The schema is set up in either case.
+// The returned Covfefe should be closed with Close when done.
+func Open(dbPath string, opts ...Option) (*Covfefe, error) {
 	c := &Covfefe{
-		withConn: func(f func(conn *sqlite.Conn) error) error {
-			conn := db.Get(nil)
-			defer db.Put(conn)
-			if err := sqliteutil.Exec(conn, "PRAGMA foreign_keys = ON;", nil); err != nil {
-				return err
-			}
-			return f(conn)
-		},
-		httpClient: &http.Client{
-			Timeout: 1 * time.Minute,
-		},
-		msgIDs:    lru.New(1 << 16),
-		mediaPath: mediaPath,
+		ctx:                context.Background(),
+		metrics:            newMetrics(),
+		log:                logrus.StandardLogger(),
+		httpClient:         &http.Client{},
+		mediaNamer:         mediaName,
+		decoder:            StreamDecoder,
+		msgIDs:             lru.New(1 << 16),
+		crawled:            lru.New(1 << 16),
+		fetch:              true,
+		maxNesting:         8,
+		sampleRate:         1,
+		mediaRetries:       3,
+		maxMediaBytes:      1 << 30,
+		mediaConcurrency:   8,
+		maxThreadDepth:     10,
+		rateLimit:          10,
+		userAgent:          defaultUserAgent,
+		requestTimeout:     1 * time.Minute,
+		busyTimeout:        10 * time.Second,
+		poolSize:           5,
+		healthWindow:       10 * time.Minute,
+		droppedLogInterval: 10 * time.Minute,
+		tweetCacheSize:     1 << 16,
+	}
+	c.store = c
+	for _, o := range opts {
+		o(c)
+	}
+	if _, ok := c.media.(mediaDeleter); c.purgeMediaOnDeletion && !ok {
+		return nil, errors.New("the media store does not support purging media")
+	}
+	if tc, ok := c.media.(tempCleaner); ok && !c.dryRun {
+		if n, err := tc.CleanTemp(); err != nil {
+			c.log.WithError(err).Warning("Failed to clean up temporary media files")
+		} else if n > 0 {
+			c.log.WithField("files", n).Info("Removed stale temporary media files")
+		}
+	}
+	if c.tweetCacheSize > 0 {
+		c.tweetIDs = lru.New(c.tweetCacheSize)
+	}
+	if c.poolSize < 1 {
+		c.poolSize = 1
+	}
+
+	uri, memory := databaseURI(dbPath)
+	flags := sqlite.SQLITE_OPEN_READWRITE | sqlite.SQLITE_OPEN_CREATE |
+		sqlite.SQLITE_OPEN_URI | sqlite.SQLITE_OPEN_NOMUTEX
+	if !memory {
+		flags |= sqlite.SQLITE_OPEN_WAL
+	}
+	db, err := sqlite.Open(uri, flags, c.poolSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open database")
+	}
+	c.close = db.Close
+	c.withConn = func(f func(conn *sqlite.Conn) error) error {
+		conn := db.Get(nil)
+		if conn == nil {
+			return errDatabaseClosed
+		}
+		defer db.Put(conn)
+		conn.SetBusyTimeout(c.busyTimeout)
+		if err := sqliteutil.Exec(conn, "PRAGMA foreign_keys = ON;", nil); err != nil {
+			return err
+		}
+		return f(conn)
+	}
+
+	c.markHandled()
+	c.mediaSem = make(chan struct{}, c.mediaConcurrency)
+	c.crawlQueue = make(chan crawlRequest, crawlQueueSize)
+	c.crawledMessages = make(chan *Message)
+	c.limiter = newHostLimiter(c.rateLimit)
+	if c.waybackRate > 0 {
+		c.wayback = newHostLimiter(c.waybackRate)
+	}
+	c.breaker = newHostBreaker()
+	c.metrics.breakerOpen.f = c.breaker.open
+
+	if err := c.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if c.publisher != nil {
+		c.startPublisher()
+	}
+	return c, nil
+}
+
+// errDatabaseClosed is returned by background work, like an abandoned media
+// download, that outlives Close.
+var errDatabaseClosed = errors.New("database is closed")
+
+var memoryDatabases uint64
+
+// databaseURI returns the SQLite URI for the dbPath passed to Open, and
+// whether it's an in-memory database. Each connection to ":memory:" would get
+// its own empty database, so it's replaced by a uniquely named one in shared
+// cache mode, which lives as long as any connection to it is open.
+func databaseURI(dbPath string) (uri string, memory bool) {
+	switch {
+	case dbPath == ":memory:":
+		n := atomic.AddUint64(&memoryDatabases, 1)
+		return fmt.Sprintf("file:covfefe-memory-%d?mode=memory&cache=shared", n), true
+	case strings.HasPrefix(dbPath, "file:"):
+		return dbPath, strings.Contains(dbPath, "mode=memory")
+	default:
+		return "file:" + dbPath, false
+	}
+}
+
+// Close closes the database, after waiting for background work like media
+// downloads to finish. If that takes longer than shutdownTimeout, Close
+// returns an error and leaves the database open for it.
+func (c *Covfefe) Close() error {
+	if !c.waitBackground(shutdownTimeout) {
+		return errors.New("background work still running, not closing the database")
 	}
+	if c.publisher != nil {
+		c.stopPublisher()
+	}
+	return c.close()
+}
 
-	if err := c.initDB(); err != nil {
+// Run follows the timelines of the accounts in creds, archiving them to the
+// database at dbPath and storing media in mediaPath, until a signal is received
+// or an error occurs.
+func Run(dbPath, mediaPath string, creds *Credentials, opts ...Option) error {
+	opts = append([]Option{WithMediaStore(&FileStore{Dir: mediaPath})}, opts...)
+	c, err := Open(dbPath, opts...)
+	if err != nil {
 		return err
 	}
+	defer c.Close()
+	return c.Run(creds)
+}
+
+// Run follows the timelines of the accounts in creds, like the Run function.
+func (c *Covfefe) Run(creds *Credentials) error {
+	c.log.Info("Starting...")
+
+	if s, err := c.Stats(); err != nil {
+		c.log.WithError(err).Warning("Failed to compute archive stats")
+	} else {
+		c.log.WithFields(logrus.Fields{
+			"tweets": s.Tweets, "users": s.Users, "follows": s.Follows,
+			"media": s.MediaFiles, "media_bytes": s.MediaBytes,
+			"first": s.FirstTweet, "last": s.LastTweet, "undelivered": s.Undelivered,
+		}).Info("Archive stats")
+	}
 
-	log.Info("Starting...")
+	ctx, cancel := contextWithSignal(context.Background(), func(s os.Signal) {
+		c.log.WithField("signal", s).Info("Received signal, stopping...")
+	}, syscall.SIGINT, syscall.SIGTERM)
+	c.ctx = ctx
+
+	if c.fetch {
+		c.wg.Add(1)
+		go func() {
+			c.retryFailedMedia()
+			c.wg.Done()
+		}()
+	}
+
+	if c.droppedLogInterval > 0 {
+		c.wg.Add(1)
+		go func() {
+			c.logDroppedProtected(ctx, c.droppedLogInterval)
+			c.wg.Done()
+		}()
+	}
 
 	messages := make(chan *Message)
 
 	c.wg.Add(1)
 	go func() {
-		c.HandleChan(messages)
+		c.HandleChan(ctx, messages, nil)
 		c.wg.Done()
 	}()
 
-	ctx, cancel := contextWithSignal(context.Background(), func(s os.Signal) {
-		log.WithField("signal", s).Info("Received signal, stopping...")
-	}, syscall.SIGINT, syscall.SIGTERM)
+	c.wg.Add(1)
+	go func() {
+		c.runCrawler(ctx)
+		c.wg.Done()
+	}()
 
 	var streamsWG sync.WaitGroup
 	config := oauth1.NewConfig(creds.APIKey, creds.APISecret)
@@ -89,16 +693,17 @@ func Run(dbPath, mediaPath string, creds *Credentials) error {
 		if err != nil {
 			return errors.Wrapf(err, "invalid credetials at position %d", i)
 		}
+		c.apiClients.Store(user.ID, httpClient)
 
 		streamsWG.Add(1)
 		go func() {
-			log.WithField("account", user.ScreenName).WithField("id", user.ID).Info(
+			c.log.WithField("account", user.ScreenName).WithField("id", user.ID).Info(
 				"Starting to monitor timeline")
 			m := &timelineMonitor{
-				ctx: ctx, c: httpClient, u: user, m: messages,
+				ctx: ctx, c: httpClient, u: user, m: messages, log: c.log,
 			}
 			err := m.followTimeline()
-			log.WithField("account", user.ScreenName).WithError(err).Error(
+			c.log.WithField("account", user.ScreenName).WithError(err).Error(
 				"Stopped following timeline") // TODO: retry
 			cancel()
 			streamsWG.Done()
@@ -107,10 +712,34 @@ func Run(dbPath, mediaPath string, creds *Credentials) error {
 	streamsWG.Wait()
 
 	close(messages)
-	c.wg.Wait()
 	return nil
 }
 
+// shutdownTimeout is how long Close waits for background work like media
+// downloads to finish after Run is stopped.
+const shutdownTimeout = 30 * time.Second
+
+// waitBackground waits for c.wg for up to timeout, and logs any media
+// downloads that are abandoned. It reports whether all background work is done.
+func (c *Covfefe) waitBackground(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		c.log.Warning("Timed out waiting for background work")
+		c.downloads.Range(func(url, tweet interface{}) bool {
+			c.log.WithField("url", url).WithField("tweet", tweet).Warning("Abandoned media download")
+			return true
+		})
+		return false
+	}
+}
+
 // contextWithSignal acts like context.WithCancel, but the returned Context is
 // also cancelled when one of the passed signals is received. A function f, if
 // not nil, is called before cancelling the Context.
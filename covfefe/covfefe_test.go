@@ -0,0 +1,51 @@
+package covfefe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestOpenMemory(t *testing.T) {
+	a, b := openTest(t), openTest(t)
+
+	msg := `{"id": 10, "created_at": "Mon Jan 02 15:04:05 +0000 2006", ` +
+		`"retweet_count": 0, "text": "hi", "user": {"id": 5, "screen_name": "public"}}`
+	if err := a.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = "SELECT id FROM Tweets;"
+	if ids := queryIDs(t, a, count); len(ids) != 1 {
+		t.Errorf("archive has %d tweets, want 1", len(ids))
+	}
+	if ids := queryIDs(t, b, count); len(ids) != 0 {
+		t.Errorf("separate in-memory archive has %d tweets, want 0", len(ids))
+	}
+}
+
+func TestCloseWaitsForBackground(t *testing.T) {
+	c, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, done := make(chan struct{}), make(chan error, 1)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		done <- c.execSQL(nil, "SELECT COUNT(*) FROM Tweets;")
+	}()
+	<-started
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("background query failed: %v", err)
+	}
+	if err := c.execSQL(nil, "SELECT 1;"); err != errDatabaseClosed {
+		t.Errorf("query after Close returned %v, want errDatabaseClosed", err)
+	}
+}
@@ -0,0 +1,226 @@
+package covfefe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// crawlParent fetches the tweet that tweet is replying to, and handles it as
+// a new message observed by the same account, which will in turn crawl its
+// own parent, up to c.maxThreadDepth. Failing to fetch the parent is not an
+// error, as it might have been deleted or protected.
+func (c *Covfefe) crawlParent(m *Message, tweet *twitter.Tweet) error {
+	return c.crawl(m, tweet.InReplyToStatusID, c.maxThreadDepth, c.log.WithFields(logrus.Fields{
+		"tweet": tweet.ID, "parent": tweet.InReplyToStatusID, "depth": m.depth,
+	}))
+}
+
+// crawlQuote is like crawlParent, but for the tweet quoted by tweet, when it
+// was not embedded in it, up to c.maxQuoteDepth.
+func (c *Covfefe) crawlQuote(m *Message, tweet *twitter.Tweet) error {
+	return c.crawl(m, tweet.QuotedStatusID, c.maxQuoteDepth, c.log.WithFields(logrus.Fields{
+		"tweet": tweet.ID, "quoted": tweet.QuotedStatusID, "depth": m.depth,
+	}))
+}
+
+// crawl queues the tweet with the given ID to be fetched by runCrawler after m
+// is committed, unless it was already archived or crawled, or m is maxDepth
+// crawls away from the timeline.
+func (c *Covfefe) crawl(m *Message, id int64, maxDepth int, log logrus.FieldLogger) error {
+	if !c.fetching() || m.account == nil {
+		return nil
+	}
+	if m.depth >= maxDepth {
+		log.Debug("Reached maximum crawl depth")
+		return nil
+	}
+	if _, ok := c.crawled.Get(id); ok {
+		return nil
+	}
+	c.crawled.Add(id, true)
+
+	client, ok := c.apiClients.Load(m.account.ID)
+	if !ok {
+		return nil
+	}
+	exists, err := c.tweetExists(m, id)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up crawled tweet")
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	r := crawlRequest{account: m.account, client: client.(*http.Client),
+		id: id, depth: m.depth + 1, log: log}
+	m.afterCommit(func() error {
+		select {
+		case c.crawlQueue <- r:
+		default:
+			c.crawled.Remove(id) // so that it can be crawled again later
+			log.Warning("Crawl queue full, dropped crawl")
+		}
+		return nil
+	})
+	return nil
+}
+
+// crawlQueueSize is how many crawls can wait for the API before new ones are
+// dropped, for example while the rate limit budget is exhausted.
+const crawlQueueSize = 1024
+
+type crawlRequest struct {
+	account *twitter.User
+	client  *http.Client
+	id      int64
+	depth   int
+	log     logrus.FieldLogger
+}
+
+// runCrawler fetches the tweets queued by crawl until ctx is done, and passes
+// them to HandleChan. Fetches run here and not in Handle, so that waiting on
+// the API rate limits only holds up other crawls, not the timelines.
+func (c *Covfefe) runCrawler(ctx context.Context) {
+	for {
+		var r crawlRequest
+		select {
+		case <-ctx.Done():
+			return
+		case r = <-c.crawlQueue:
+		}
+		msg, err := c.fetchTweet(r.client, r.id)
+		if errors.Cause(err) == errTweetUnavailable {
+			r.log.WithError(err).Debug("Crawled tweet is unavailable")
+			continue
+		}
+		if err != nil {
+			r.log.WithError(err).Warning("Failed to fetch crawled tweet")
+			continue
+		}
+		r.log.Debug("Fetched crawled tweet")
+		select {
+		case c.crawledMessages <- &Message{account: r.account, msg: msg, depth: r.depth}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// showEndpoint is the REST API endpoint that returns a single tweet.
+const showEndpoint = "https://api.twitter.com/1.1/statuses/show.json"
+
+// errTweetUnavailable is returned by fetchTweet for tweets that the API
+// reported as deleted, protected or otherwise unavailable.
+var errTweetUnavailable = errors.New("tweet unavailable")
+
+// fetchTweet fetches the raw JSON of the tweet with the given ID from the REST
+// API with client, so that it can be handled as a new message. It waits for the
+// rate limit window of the endpoint to reset if its budget is exhausted, and
+// retries once if the request is rate limited anyway. Tweets that the API says
+// are unavailable are recorded in UnavailableTweets, and not fetched again.
+func (c *Covfefe) fetchTweet(client *http.Client, id int64) (json.RawMessage, error) {
+	unavailable, err := c.tweetUnavailable(id)
+	if err != nil {
+		return nil, err
+	}
+	if unavailable {
+		return nil, errTweetUnavailable
+	}
+
+	url := fmt.Sprintf("%s?id=%d&%s", showEndpoint, id, extraParams)
+	for attempt := 0; ; attempt++ {
+		if err := c.apiBudget.wait(c.ctx, client, showEndpoint); err != nil {
+			return nil, err
+		}
+		var tweet json.RawMessage
+		h, err := getJSONHeader(c.ctx, client, url, &tweet)
+		c.apiBudget.update(client, showEndpoint, h)
+		apiErr, _ := errors.Cause(err).(*apiError)
+		switch {
+		case err == nil:
+			return tweet, nil
+		case apiErr == nil:
+			return nil, err
+		case apiErr.status == http.StatusTooManyRequests && attempt == 0:
+			c.log.WithField("tweet", id).Warning("Rate limited by the API, waiting")
+			continue
+		case apiErr.status == http.StatusNotFound || apiErr.status == http.StatusForbidden:
+			if uerr := c.insertUnavailableTweet(id, apiErr.status); uerr != nil {
+				c.log.WithError(uerr).WithField("tweet", id).Error("Failed to insert unavailable tweet")
+			}
+			return nil, errors.Wrap(errTweetUnavailable, err.Error())
+		default:
+			return nil, err
+		}
+	}
+}
+
+// apiBudget tracks the rate limit windows of REST API endpoints for each
+// client, as reported by the x-rate-limit-* headers of their responses. The
+// zero value is ready to use.
+type apiBudget struct {
+	mu      sync.Mutex
+	windows map[apiEndpoint]apiWindow
+}
+
+type apiEndpoint struct {
+	client   *http.Client
+	endpoint string
+}
+
+type apiWindow struct {
+	remaining int
+	reset     time.Time
+}
+
+// wait blocks until the window of endpoint has budget left, or ctx is done.
+// Endpoints that didn't report a rate limit yet are allowed.
+func (b *apiBudget) wait(ctx context.Context, client *http.Client, endpoint string) error {
+	b.mu.Lock()
+	w, ok := b.windows[apiEndpoint{client, endpoint}]
+	b.mu.Unlock()
+	if !ok || w.remaining > 0 {
+		return nil
+	}
+	d := time.Until(w.reset)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d + time.Second) // some slack for clock skew
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update records the rate limit window from the headers of a response from
+// endpoint, if it has them.
+func (b *apiBudget) update(client *http.Client, endpoint string, h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(h.Get("x-rate-limit-reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.windows == nil {
+		b.windows = make(map[apiEndpoint]apiWindow)
+	}
+	b.windows[apiEndpoint{client, endpoint}] = apiWindow{remaining, time.Unix(reset, 0)}
+}
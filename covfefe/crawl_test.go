@@ -0,0 +1,38 @@
+package covfefe
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAPIBudget(t *testing.T) {
+	var b apiBudget
+	client := &http.Client{}
+	if err := b.wait(context.Background(), client, showEndpoint); err != nil {
+		t.Fatalf("wait without a window: %v", err)
+	}
+
+	header := func(remaining int, reset time.Time) http.Header {
+		h := make(http.Header)
+		h.Set("x-rate-limit-remaining", strconv.Itoa(remaining))
+		h.Set("x-rate-limit-reset", strconv.FormatInt(reset.Unix(), 10))
+		return h
+	}
+	b.update(client, showEndpoint, header(0, time.Now().Add(-time.Minute)))
+	if err := b.wait(context.Background(), client, showEndpoint); err != nil {
+		t.Fatalf("wait after the reset: %v", err)
+	}
+
+	b.update(client, showEndpoint, header(0, time.Now().Add(time.Hour)))
+	if err := b.wait(context.Background(), &http.Client{}, showEndpoint); err != nil {
+		t.Fatalf("wait with another client: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx, client, showEndpoint); err != context.DeadlineExceeded {
+		t.Fatalf("wait with an exhausted budget = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
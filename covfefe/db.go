@@ -1,70 +1,103 @@
 package covfefe
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqliteutil"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/blake2b"
+	"github.com/sirupsen/logrus"
 )
 
-func (c *Covfefe) execSQL(query string, args ...interface{}) error {
-	return c.withConn(func(conn *sqlite.Conn) error {
+// store writes the core tables derived from messages. Processing goes through
+// c.store, which is the Covfefe itself unless replaced by tests that need to
+// observe what's written for a given message.
+type store interface {
+	insertMessage(m *Message) error
+	insertTweet(tweet *twitter.Tweet, conversation int64, compact bool, m *Message) (new bool, err error)
+	insertUser(user *twitter.User, m *Message) (new bool, err error)
+	insertFollow(follower, target int64, m *Message) error
+	deletedTweet(tweet int64, m *Message) error
+}
+
+// execSQL runs a query that doesn't return rows, in the transaction of m, see
+// withMessageConn. m is nil for work that is not part of handling a message. In
+// dry run mode it does nothing, as all such queries modify the database.
+func (c *Covfefe) execSQL(m *Message, query string, args ...interface{}) error {
+	if c.dryRun {
+		return nil
+	}
+	return c.withMessageConn(m, func(conn *sqlite.Conn) error {
 		return sqliteutil.Exec(conn, query, nil, args...)
 	})
 }
 
-func (c *Covfefe) initDB() error {
-	return errors.Wrap(c.withConn(func(conn *sqlite.Conn) error {
-		return sqliteutil.ExecScript(conn, `
-			CREATE TABLE IF NOT EXISTS Messages (
-				id INTEGER PRIMARY KEY,
-				received DATETIME DEFAULT (DATETIME('now')),
-				json TEXT NOT NULL,
-				account TEXT NOT NULL -- JSON array of IDs
-			);
-			CREATE TABLE IF NOT EXISTS Tweets (
-				id INTEGER PRIMARY KEY,
-				created DATETIME NOT NULL,
-				user INTEGER NOT NULL,
-				message INTEGER NOT NULL REFERENCES Messages(id),
-				deleted INTEGER REFERENCES Messages(id)
-			);
-			CREATE TABLE IF NOT EXISTS Users (
-				id INTEGER NOT NULL,
-				handle TEXT NOT NULL,
-				name TEXT NOT NULL,
-				bio TEXT NOT NULL,
-				first_seen INTEGER NOT NULL REFERENCES Messages(id),
-				UNIQUE (id, handle, name, bio) ON CONFLICT IGNORE
-			);
-			CREATE TABLE IF NOT EXISTS Follows (
-				follower INTEGER NOT NULL,
-				target INTEGER NOT NULL,
-				first_seen INTEGER NOT NULL REFERENCES Messages(id),
-				UNIQUE (target, follower) ON CONFLICT IGNORE
-			);`)
-	}), "failed to initialize database")
+// withMessageConn runs f with the connection of the transaction m is being
+// handled in, see inTransaction, or with one from the pool if m is nil or is
+// not being handled, like after its transaction is done.
+func (c *Covfefe) withMessageConn(m *Message, f func(conn *sqlite.Conn) error) error {
+	if m != nil && m.conn != nil {
+		return f(m.conn)
+	}
+	return c.withConn(f)
+}
+
+// inTransaction runs f with a connection in a transaction, which is rolled back
+// if f returns an error. The database operations made for a message only join
+// the transaction if its conn is set to the one passed to f.
+func (c *Covfefe) inTransaction(f func(conn *sqlite.Conn) error) error {
+	return c.withConn(func(conn *sqlite.Conn) (err error) {
+		defer sqliteutil.Save(conn)(&err)
+		return f(conn)
+	})
+}
+
+// forgetMessage undoes insertMessage after its transaction was rolled back.
+// The message might have been a duplicate of one that is still stored.
+func (c *Covfefe) forgetMessage(m *Message) {
+	var exists bool
+	err := c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM Messages WHERE id = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			}, m.id)
+	})
+	if err != nil || !exists {
+		c.msgIDs.Remove(c.messageKey(m))
+	}
+	m.id = 0
 }
 
 func (c *Covfefe) insertMessage(m *Message) error {
 	if m.id != 0 {
-		log.WithField("id", m.id).Debug("Read message")
+		c.log.WithField("id", m.id).Debug("Read message")
 		return nil
 	}
 
-	h := blake2b.Sum256(m.msg)
+	h := c.messageKey(m)
+
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"account": m.account.ScreenName, "hash": base64.RawURLEncoding.EncodeToString(h[:]),
+		}).Info("Dry run: would insert message")
+		return nil
+	}
 
 	if id, ok := c.msgIDs.Get(h); ok {
-		log.WithFields(log.Fields{
+		c.log.WithFields(logrus.Fields{
 			"id": id, "account": m.account.ScreenName, "hash": base64.RawURLEncoding.EncodeToString(h[:]),
 		}).Debug("Duplicate message")
 
-		err := c.execSQL(`UPDATE Messages SET account = json_insert(
+		err := c.execSQL(m, `UPDATE Messages SET account = json_insert(
 			account, '$[' || json_array_length(account) || ']', ?) WHERE id = ?;`, m.account.ID, id)
 		if err != nil {
 			return errors.Wrap(err, "failed update query")
@@ -73,10 +106,16 @@ func (c *Covfefe) insertMessage(m *Message) error {
 		return nil
 	}
 
-	err := c.withConn(func(conn *sqlite.Conn) error {
-		err := sqliteutil.Exec(conn,
-			`INSERT INTO Messages (json, account) VALUES (?, json_array(?))`,
-			nil, m.msg, m.account.ID)
+	query := `INSERT INTO Messages (json, account, created, compressed) VALUES (?, json_array(?), ?, 0)`
+	data := m.msg
+	if c.compressMessages {
+		// sqliteutil binds []byte as TEXT, which SQL functions would
+		// truncate at the first NUL byte.
+		query = `INSERT INTO Messages (json, account, created, compressed) VALUES (CAST(? AS BLOB), json_array(?), ?, 1)`
+		data = compressMessage(m.msg)
+	}
+	err := c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		err := sqliteutil.Exec(conn, query, nil, data, m.account.ID, c.eventCreated(m))
 		if err != nil {
 			return err
 		}
@@ -87,7 +126,7 @@ func (c *Covfefe) insertMessage(m *Message) error {
 		return errors.Wrap(err, "failed insert query")
 	}
 
-	log.WithFields(log.Fields{
+	c.log.WithFields(logrus.Fields{
 		"id": m.id, "account": m.account.ScreenName, "hash": base64.RawURLEncoding.EncodeToString(h[:]),
 	}).Debug("New message")
 
@@ -95,42 +134,715 @@ func (c *Covfefe) insertMessage(m *Message) error {
 	return nil
 }
 
-func (c *Covfefe) insertTweet(tweet *twitter.Tweet, message int64) (new bool, err error) {
-	err = c.execSQL(
-		`INSERT INTO Tweets (id, created, user, message) VALUES (?, ?, ?, ?)`,
-		tweet.ID, mustParseTime(tweet.CreatedAt), tweet.User.ID, message)
+// compressMessage gzips a raw message for storage, see WithCompressMessages.
+func compressMessage(msg []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// Writes to a bytes.Buffer can't fail.
+	zw.Write(msg)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// storedJSON reads a raw message from the json column of Messages, which is
+// gzip compressed if the compressed column is set.
+func storedJSON(r io.Reader, compressed bool) ([]byte, error) {
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid compressed message")
+		}
+		r = zr
+	}
+	msg, err := ioutil.ReadAll(r)
+	return msg, errors.Wrap(err, "failed to read message")
+}
+
+// insertTweet stores tweet, unless it's already stored, in which case it's
+// refreshed or upgraded according to the ConflictStrategy. conversation is the
+// ID of the first tweet of its thread, or zero if unknown, and compact is
+// whether the tweet lacks entities, see compactTweet. Upgrading a compact tweet
+// to its full version counts as new, so that it's processed again.
+func (c *Covfefe) insertTweet(tweet *twitter.Tweet, conversation int64, compact bool, m *Message) (new bool, err error) {
+	if c.tweetIDs != nil && c.tweetConflicts != UpdateConflicts {
+		if _, ok := c.tweetIDs.Get(tweet.ID); ok {
+			return false, nil
+		}
+	}
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"tweet": tweet.ID, "user": tweet.User.ID, "message": m.id,
+		}).Info("Dry run: would insert tweet")
+		return true, nil
+	}
+	var source, lang, conv interface{}
+	if conversation != 0 {
+		conv = conversation
+	}
+	if s := sourceName(tweet.Source); s != "" {
+		source = s
+	}
+	if tweet.Lang != "" {
+		lang = tweet.Lang
+	}
+	text := fullText(tweet)
+	created, err := parseTwitterTime(tweet.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	if c.tweetConflicts != IgnoreConflicts {
+		return c.upsertTweet(tweet, created, m, source, lang, text, conv, compact)
+	}
+	start, end := displayColumns(tweet, text)
+	err = c.execSQL(m,
+		`INSERT INTO Tweets (id, created, user, message, source, lang, text, sensitive, conversation,
+			favorites, retweets, compact, display_start, display_end,
+			reply_to, reply_to_user, reply_to_handle)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''))`,
+		tweet.ID, created, tweet.User.ID, m.id, source, lang, text, tweet.PossiblySensitive, conv,
+		tweet.FavoriteCount, tweet.RetweetCount, compact, start, end,
+		tweet.InReplyToStatusID, tweet.InReplyToUserID, tweet.InReplyToScreenName)
 	if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
 		return false, nil
 	}
 	if err != nil {
 		return false, errors.Wrap(err, "failed insert query")
 	}
+	err = c.execSQL(m, `INSERT INTO TweetsText (rowid, text) VALUES (?, ?)`,
+		tweet.ID, text)
+	if err != nil {
+		return false, errors.Wrap(err, "failed index query")
+	}
 	return true, nil
 }
 
-func (c *Covfefe) insertUser(user *twitter.User, message int64) error {
-	return errors.Wrap(c.execSQL(
-		`INSERT INTO Users (id, handle, name, bio, first_seen) VALUES (?, ?, ?, ?, ?);`,
-		user.ID, user.ScreenName, user.Name, user.Description, message), "failed insert query")
+// upsertTweet is insertTweet for UpdateConflicts and UpgradeCompact. When a
+// compact tweet is upgraded, the full version also replaces its message.
+func (c *Covfefe) upsertTweet(tweet *twitter.Tweet, created time.Time, m *Message,
+	source, lang interface{}, text string, conv interface{}, compact bool) (new bool, err error) {
+	var exists, storedCompact bool
+	err = c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT compact FROM Tweets WHERE id = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				exists, storedCompact = true, stmt.ColumnInt(0) != 0
+				return nil
+			}, tweet.ID)
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed select query")
+	}
+	upgrade := exists && storedCompact && !compact
+	if exists && !upgrade && c.tweetConflicts == UpgradeCompact {
+		return false, nil
+	}
+
+	start, end := displayColumns(tweet, text)
+	err = c.execSQL(m,
+		`INSERT INTO Tweets (id, created, user, message, source, lang, text, sensitive, conversation,
+			favorites, retweets, compact, display_start, display_end,
+			reply_to, reply_to_user, reply_to_handle)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''))
+		ON CONFLICT (id) DO UPDATE SET
+			text = CASE WHEN excluded.compact AND NOT compact THEN text ELSE excluded.text END,
+			display_start = CASE WHEN excluded.compact AND NOT compact
+				THEN display_start ELSE excluded.display_start END,
+			display_end = CASE WHEN excluded.compact AND NOT compact
+				THEN display_end ELSE excluded.display_end END,
+			reply_to = COALESCE(reply_to, excluded.reply_to),
+			reply_to_user = COALESCE(reply_to_user, excluded.reply_to_user),
+			reply_to_handle = COALESCE(excluded.reply_to_handle, reply_to_handle),
+			lang = COALESCE(excluded.lang, lang), source = COALESCE(excluded.source, source),
+			sensitive = excluded.sensitive, conversation = COALESCE(conversation, excluded.conversation),
+			favorites = excluded.favorites, retweets = excluded.retweets, updated = excluded.message,
+			message = CASE WHEN compact AND NOT excluded.compact THEN excluded.message ELSE message END,
+			compact = compact AND excluded.compact;`,
+		tweet.ID, created, tweet.User.ID, m.id, source, lang, text, tweet.PossiblySensitive, conv,
+		tweet.FavoriteCount, tweet.RetweetCount, compact, start, end,
+		tweet.InReplyToStatusID, tweet.InReplyToUserID, tweet.InReplyToScreenName)
+	if err != nil {
+		return false, errors.Wrap(err, "failed upsert query")
+	}
+	if exists {
+		// A compact copy would truncate the indexed text of a full one.
+		if !compact || storedCompact {
+			err = c.execSQL(m, `UPDATE TweetsText SET text = ? WHERE rowid = ?`, text, tweet.ID)
+		}
+	} else {
+		err = c.execSQL(m, `INSERT INTO TweetsText (rowid, text) VALUES (?, ?)`, tweet.ID, text)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed index query")
+	}
+	if upgrade {
+		c.log.WithField("tweet", tweet.ID).WithField("message", m.id).Debug("Upgraded compact tweet")
+	}
+	return !exists || upgrade, nil
+}
+
+// displayColumns returns the values of Tweets.display_start and display_end for
+// tweet, which are NULL if its display range is unknown.
+func displayColumns(tweet *twitter.Tweet, text string) (start, end interface{}) {
+	if r, ok := displayTextRange(tweet, text); ok {
+		return r.Start(), r.End()
+	}
+	return nil, nil
+}
+
+func (c *Covfefe) insertTweetJSON(tweet int64, data []byte, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO TweetJSON (tweet, json, message) VALUES (?, ?, ?);`,
+		tweet, data, m.id), "failed insert query")
+}
+
+func (c *Covfefe) tweetExists(m *Message, id int64) (exists bool, err error) {
+	err = c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM Tweets WHERE id = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			}, id)
+	})
+	return exists, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertUnavailableTweet(id int64, status int) error {
+	return errors.Wrap(c.execSQL(nil,
+		`INSERT INTO UnavailableTweets (id, status) VALUES (?, ?);`,
+		id, status), "failed insert query")
+}
+
+func (c *Covfefe) tweetUnavailable(id int64) (unavailable bool, err error) {
+	err = c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM UnavailableTweets WHERE id = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				unavailable = true
+				return nil
+			}, id)
+	})
+	return unavailable, errors.Wrap(err, "failed select query")
+}
+
+// insertUser stores user, and reports whether it's new, that is if its handle,
+// name or bio were never seen before.
+func (c *Covfefe) insertUser(user *twitter.User, m *Message) (new bool, err error) {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"user": user.ID, "handle": user.ScreenName, "message": m.id,
+		}).Info("Dry run: would insert user")
+		return true, nil
+	}
+	err = c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		err := sqliteutil.Exec(conn,
+			`INSERT INTO Users (id, handle, name, bio, first_seen) VALUES (?, ?, ?, ?, ?);`,
+			nil, user.ID, user.ScreenName, user.Name, user.Description, m.id)
+		new = conn.Changes() > 0
+		return err
+	})
+	return new, errors.Wrap(err, "failed insert query")
 }
 
-func (c *Covfefe) insertFollow(follower, target, message int64) error {
-	return errors.Wrap(c.execSQL(
+func (c *Covfefe) insertPinnedTweet(user, tweet int64, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO PinnedTweets (user, tweet, observed, message)
+			SELECT ?, ?, received, id FROM Messages WHERE id = ?;`,
+		user, tweet, m.id), "failed insert query")
+}
+
+// lastPinnedTweets returns the pinned tweets of the latest observation of
+// user, or nil if there is none.
+func (c *Covfefe) lastPinnedTweets(m *Message, user int64) ([]int64, error) {
+	var res []int64
+	err := c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT tweet FROM PinnedTweets WHERE user = ?
+			AND message = (SELECT MAX(message) FROM PinnedTweets WHERE user = ?);`,
+			func(stmt *sqlite.Stmt) error {
+				res = append(res, stmt.ColumnInt64(0))
+				return nil
+			}, user, user)
+	})
+	return res, errors.Wrap(err, "failed select query")
+}
+
+// insertEditHistory records the versions of the tweet first posted as initial,
+// in order, and flags the latest one known.
+func (c *Covfefe) insertEditHistory(initial int64, versions []int64, m *Message) error {
+	for i, tweet := range versions {
+		if err := c.execSQL(m, `INSERT INTO EditHistory (initial, tweet, version, message)
+			VALUES (?, ?, ?, ?);`, initial, tweet, i, m.id); err != nil {
+			return errors.Wrap(err, "failed insert query")
+		}
+	}
+	return errors.Wrap(c.execSQL(m, `UPDATE EditHistory SET latest = (version =
+			(SELECT MAX(version) FROM EditHistory e WHERE e.initial = EditHistory.initial))
+		WHERE initial = ?;`, initial), "failed update query")
+}
+
+func (c *Covfefe) insertFollow(follower, target int64, m *Message) error {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"follower": follower, "target": target, "message": m.id,
+		}).Info("Dry run: would insert follow")
+		return nil
+	}
+	return errors.Wrap(c.execSQL(m,
 		`INSERT INTO Follows (follower, target, first_seen) VALUES (?, ?, ?);`,
-		follower, target, message), "failed insert query")
+		follower, target, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertFavorite(user, tweet int64, added bool, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Favorites (user, tweet, added, message) VALUES (?, ?, ?, ?);`,
+		user, tweet, added, m.id), "failed insert query")
+}
+
+// insertQuote records that tweet by user quotes quoted by quotedUser. Unknown
+// users are zero, and are filled in if a later observation knows them.
+func (c *Covfefe) insertQuote(tweet, quoted, user, quotedUser int64, m *Message) error {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"tweet": tweet, "quoted": quoted, "message": m.id,
+		}).Info("Dry run: would insert quote")
+		return nil
+	}
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Quotes (tweet, quoted, user, quoted_user, message)
+			VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0), ?)
+		ON CONFLICT (tweet, quoted) DO UPDATE SET user = COALESCE(user, excluded.user),
+			quoted_user = COALESCE(quoted_user, excluded.quoted_user);`,
+		tweet, quoted, user, quotedUser, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertRetweet(tweet, original, user int64, m *Message) error {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"tweet": tweet, "original": original, "user": user, "message": m.id,
+		}).Info("Dry run: would insert retweet")
+		return nil
+	}
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Retweets (tweet, original, user, message) VALUES (?, ?, ?, ?);`,
+		tweet, original, user, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertMedia(id, tweet int64, mf *mediaFile, name string) error {
+	return errors.Wrap(c.execSQL(nil,
+		`INSERT INTO Media (id, tweet, hash, name, type, width, height, size) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+		id, tweet, mf.hash, name, mf.mime, mf.width, mf.height, mf.size), "failed insert query")
 }
 
-func (c *Covfefe) deletedTweet(tweet, message int64) {
-	err := c.execSQL(`UPDATE Tweets SET deleted = ? WHERE id = ?`, message, tweet)
+// storedMedia returns the largest stored copy of the media with the given ID
+// and the same kind as mimeType, or nil if there is none. Media stored before
+// the type was recorded is ignored.
+func (c *Covfefe) storedMedia(id int64, mimeType string) (name string, mf *mediaFile, err error) {
+	kind := strings.SplitN(mimeType, "/", 2)[0]
+	err = c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT name, hash, type, width, height, size FROM Media
+			WHERE id = ? AND type LIKE ? ORDER BY width * height DESC, size DESC LIMIT 1;`,
+			func(stmt *sqlite.Stmt) error {
+				name = stmt.ColumnText(0)
+				mf = &mediaFile{
+					hash:   stmt.ColumnText(1),
+					mime:   stmt.ColumnText(2),
+					width:  stmt.ColumnInt(3),
+					height: stmt.ColumnInt(4),
+					size:   stmt.ColumnInt64(5),
+				}
+				return nil
+			}, id, kind+"/%")
+	})
+	return name, mf, errors.Wrap(err, "failed select query")
+}
+
+// unsharedMedia returns the names of the stored files of the media of tweet
+// that are not also the media of other tweets that were not deleted.
+func (c *Covfefe) unsharedMedia(m *Message, tweet int64) ([]string, error) {
+	var names []string
+	err := c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT DISTINCT name FROM Media AS m WHERE tweet = ?
+			AND NOT EXISTS (SELECT 1 FROM Media AS o WHERE o.hash = m.hash AND o.tweet != m.tweet
+				AND o.tweet NOT IN (SELECT id FROM Tweets WHERE deleted IS NOT NULL));`,
+			func(stmt *sqlite.Stmt) error {
+				names = append(names, stmt.ColumnText(0))
+				return nil
+			}, tweet)
+	})
+	return names, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) deleteMediaFile(m *Message, name string) error {
+	return errors.Wrap(c.execSQL(m,
+		`DELETE FROM Media WHERE name = ?;`, name), "failed delete query")
+}
+
+func (c *Covfefe) deleteMedia(id int64, hash string) error {
+	return errors.Wrap(c.execSQL(nil,
+		`DELETE FROM Media WHERE id = ? AND hash = ?;`,
+		id, hash), "failed delete query")
+}
+
+// mediaByHash returns the name of a stored file with the given contents hash,
+// or an empty string if there is none.
+func (c *Covfefe) mediaByHash(hash string) (name string, err error) {
+	err = c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT name FROM Media WHERE hash = ? LIMIT 1;`,
+			func(stmt *sqlite.Stmt) error {
+				name = stmt.ColumnText(0)
+				return nil
+			}, hash)
+	})
+	return name, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertProfileImage(user int64, kind, url, hash, name string, message int64) error {
+	return errors.Wrap(c.execSQL(nil,
+		`INSERT INTO ProfileImages (user, kind, url, hash, name, first_seen) VALUES (?, ?, ?, ?, ?, ?);`,
+		user, kind, url, hash, name, message), "failed insert query")
+}
+
+func (c *Covfefe) profileImageExists(url string) (bool, error) {
+	var exists bool
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM ProfileImages WHERE url = ? LIMIT 1;`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			}, url)
+	})
+	return exists, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) profileImageStored(name string) (bool, error) {
+	var exists bool
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM ProfileImages WHERE name = ? LIMIT 1;`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			}, name)
+	})
+	return exists, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertCardImage(tweet int64, url, hash, name string, message int64) error {
+	return errors.Wrap(c.execSQL(nil,
+		`INSERT INTO CardImages (tweet, url, hash, name, message) VALUES (?, ?, ?, ?, ?);`,
+		tweet, url, hash, name, message), "failed insert query")
+}
+
+func (c *Covfefe) cardImageExists(tweet int64, url string) (bool, error) {
+	var exists bool
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM CardImages WHERE tweet = ? AND url = ? LIMIT 1;`,
+			func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			}, tweet, url)
+	})
+	return exists, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertHashtag(tweet int64, tag string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Hashtags (tweet, tag, message) VALUES (?, ?, ?);`,
+		tweet, tag, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertSymbol(tweet int64, symbol string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Symbols (tweet, symbol, message) VALUES (?, ?, ?);`,
+		tweet, symbol, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertMention(tweet, user int64, handle string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Mentions (tweet, user, handle, message) VALUES (?, ?, ?, ?);`,
+		tweet, user, handle, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertDirectMessage(dm *twitter.DirectMessage, m *Message) error {
+	created, err := parseTwitterTime(dm.CreatedAt)
 	if err != nil {
-		log.WithError(err).WithField("tweet", tweet).Error("Failed to delete tweet")
+		return err
 	}
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO DirectMessages (id, created, sender, recipient, text, message) VALUES (?, ?, ?, ?, ?, ?);`,
+		dm.ID, created, dm.SenderID, dm.RecipientID, dm.Text, m.id), "failed insert query")
 }
 
-func mustParseTime(CreatedAt string) time.Time {
-	t, err := time.Parse(time.RubyDate, CreatedAt)
+// insertStatusWithheld records that status was withheld in country. Like for
+// insertUserWithheld, the observation time is copied from the message, so that
+// it survives a rescan.
+func (c *Covfefe) insertStatusWithheld(status, user int64, country, scope string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO StatusWithheld (status, user, country, scope, observed, message)
+			SELECT ?, ?, ?, ?, received, id FROM Messages WHERE id = ?;`,
+		status, user, country, scope, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertUserWithheld(user int64, country, scope string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO UserWithheld (user, country, scope, observed, message)
+			SELECT ?, ?, ?, received, id FROM Messages WHERE id = ?;`,
+		user, country, scope, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertDeletion(tweet, user, account int64, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Deletions (tweet, user, account, observed, message)
+			SELECT ?, ?, ?, received, id FROM Messages WHERE id = ?;`,
+		tweet, user, account, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertStreamLimit(track int64, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO StreamLimits (track, observed, message)
+			SELECT ?, received, id FROM Messages WHERE id = ?;`,
+		track, m.id), "failed insert query")
+}
+
+// insertEngagement records the counts of tweet as seen in message. The
+// observation time is copied from the message, like for insertDeletion.
+func (c *Covfefe) insertEngagement(tweet int64, favorites, retweets, replies, quotes interface{}, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Engagement (tweet, favorites, retweets, replies, quotes, observed, message)
+			SELECT ?, ?, ?, ?, ?, received, id FROM Messages WHERE id = ?;`,
+		tweet, favorites, retweets, replies, quotes, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertTweetAccount(tweet, account int64, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO TweetAccounts (tweet, account, first_seen) VALUES (?, ?, ?);`,
+		tweet, account, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertUserAccount(user, account int64, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO UserAccounts (user, account, first_seen) VALUES (?, ?, ?);`,
+		user, account, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertURL(tweet int64, url, expanded string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO URLs (tweet, url, expanded, wayback, message)
+			VALUES (?, ?, ?, (SELECT wayback FROM WaybackURLs WHERE url = ?), ?);`,
+		tweet, url, expanded, expanded, m.id), "failed insert query")
+}
+
+// insertWaybackURL records the snapshot of the expanded URL url, and sets it
+// on the URLs that link to it.
+func (c *Covfefe) insertWaybackURL(url, wayback string) error {
+	if err := c.execSQL(nil, `INSERT INTO WaybackURLs (url, wayback) VALUES (?, ?);`,
+		url, wayback); err != nil {
+		return errors.Wrap(err, "failed insert query")
+	}
+	return errors.Wrap(c.execSQL(nil, `UPDATE URLs SET wayback = ? WHERE expanded = ?;`,
+		wayback, url), "failed update query")
+}
+
+func (c *Covfefe) insertResolvedURL(url, final string, status int) error {
+	return errors.Wrap(c.execSQL(nil,
+		`INSERT INTO ResolvedURLs (url, final, status) VALUES (?, ?, ?);`,
+		url, final, status), "failed insert query")
+}
+
+func (c *Covfefe) urlResolved(url string) (resolved bool, err error) {
+	err = c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT 1 FROM ResolvedURLs WHERE url = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				resolved = true
+				return nil
+			}, url)
+	})
+	return resolved, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertMediaError(id, tweet int64, url, e string) error {
+	return errors.Wrap(c.execSQL(nil, `INSERT INTO MediaErrors (media, tweet, url, error) VALUES (?, ?, ?, ?)
+		ON CONFLICT (media, url) DO UPDATE SET error = excluded.error,
+		attempts = attempts + 1, last_attempt = DATETIME('now');`,
+		id, tweet, url, e), "failed insert query")
+}
+
+func (c *Covfefe) clearMediaError(id int64, url string) error {
+	return errors.Wrap(c.execSQL(nil,
+		`DELETE FROM MediaErrors WHERE media = ? AND url = ?;`,
+		id, url), "failed delete query")
+}
+
+// failedMedia returns the recorded media errors with less than maxAttempts.
+func (c *Covfefe) failedMedia(maxAttempts int) ([]mediaDownload, error) {
+	var res []mediaDownload
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT media, tweet, url FROM MediaErrors
+			WHERE attempts < ? ORDER BY last_attempt;`,
+			func(stmt *sqlite.Stmt) error {
+				res = append(res, mediaDownload{
+					media: stmt.GetInt64("media"),
+					tweet: stmt.GetInt64("tweet"),
+					url:   stmt.GetText("url"),
+				})
+				return nil
+			}, maxAttempts)
+	})
+	return res, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertPendingMedia(d mediaDownload, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO PendingMedia (media, tweet, url, message) VALUES (?, ?, ?, ?);`,
+		d.media, d.tweet, d.url, m.id), "failed insert query")
+}
+
+func (c *Covfefe) deletePendingMedia(d mediaDownload) error {
+	return errors.Wrap(c.execSQL(nil,
+		`DELETE FROM PendingMedia WHERE media = ? AND url = ?;`,
+		d.media, d.url), "failed delete query")
+}
+
+// pendingMedia returns up to limit media recorded for later download, oldest
+// first.
+func (c *Covfefe) pendingMedia(limit int) ([]mediaDownload, error) {
+	var res []mediaDownload
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT media, tweet, url FROM PendingMedia
+			ORDER BY message, media, url LIMIT ?;`,
+			func(stmt *sqlite.Stmt) error {
+				res = append(res, mediaDownload{
+					media: stmt.GetInt64("media"),
+					tweet: stmt.GetInt64("tweet"),
+					url:   stmt.GetText("url"),
+				})
+				return nil
+			}, limit)
+	})
+	return res, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) countPendingMedia() (n int64, err error) {
+	err = c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT COUNT(*) FROM PendingMedia;`,
+			func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt64(0)
+				return nil
+			})
+	})
+	return n, errors.Wrap(err, "failed select query")
+}
+
+func (c *Covfefe) insertPollChoice(tweet int64, choice int, label string,
+	votes int64, ends interface{}, final bool, m *Message) error {
+	return errors.Wrap(c.execSQL(m, `INSERT INTO Polls
+		(tweet, message, observed, choice, label, votes, ends, final) VALUES
+		(?, ?, (SELECT received FROM Messages WHERE id = ?), ?, ?, ?, ?, ?);`,
+		tweet, m.id, m.id, choice, label, votes, ends, final), "failed insert query")
+}
+
+func (c *Covfefe) insertPlace(p *twitter.Place, bbox string, m *Message) error {
+	return errors.Wrap(c.execSQL(m, `INSERT INTO Places
+		(id, name, full_name, type, country, country_code, bounding_box, first_seen)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?);`,
+		p.ID, p.Name, p.FullName, p.PlaceType, p.Country, p.CountryCode, bbox, m.id),
+		"failed insert query")
+}
+
+func (c *Covfefe) insertLocation(tweet int64, place, lon, lat interface{}, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO Locations (tweet, place, longitude, latitude, message) VALUES (?, ?, ?, ?, ?);`,
+		tweet, place, lon, lat, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertAltText(media, tweet int64, text string, m *Message) error {
+	return errors.Wrap(c.execSQL(m,
+		`INSERT INTO AltTexts (media, tweet, text, message) VALUES (?, ?, ?, ?);`,
+		media, tweet, text, m.id), "failed insert query")
+}
+
+func (c *Covfefe) insertMediaInfo(media, tweet int64, mediaType string,
+	width, height, duration, aspectWidth, aspectHeight interface{}, m *Message) error {
+	return errors.Wrap(c.execSQL(m, `INSERT INTO MediaInfo (media, tweet, type, width, height,
+		duration_ms, aspect_width, aspect_height, message) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		media, tweet, mediaType, width, height, duration, aspectWidth, aspectHeight, m.id),
+		"failed insert query")
+}
+
+func (c *Covfefe) deletedTweet(tweet int64, m *Message) error {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"tweet": tweet, "message": m.id,
+		}).Info("Dry run: would mark tweet deleted")
+		return nil
+	}
+	err := c.execSQL(m, `UPDATE Tweets SET deleted = ? WHERE id = ?`, m.id, tweet)
 	if err != nil {
-		log.WithError(err).WithField("string", CreatedAt).Fatal("Failed to parse created time")
+		return errors.Wrap(err, "failed update query")
+	}
+	// Deleted tweets are kept, but not returned by searches.
+	err = c.execSQL(m, `DELETE FROM TweetsText WHERE rowid = ?`, tweet)
+	return errors.Wrap(err, "failed unindex query")
+}
+
+// scrubGeo removes the location of the tweets by user up to and including
+// the tweet upTo, and returns how many were removed. Places are not specific
+// to a user, and are kept.
+func (c *Covfefe) scrubGeo(user, upTo int64, m *Message) (n int, err error) {
+	if c.dryRun {
+		c.log.WithFields(logrus.Fields{
+			"user": user, "up_to": upTo, "message": m.id,
+		}).Info("Dry run: would scrub locations")
+		return 0, nil
+	}
+	err = c.withMessageConn(m, func(conn *sqlite.Conn) error {
+		err := sqliteutil.Exec(conn, `DELETE FROM Locations WHERE tweet IN (
+			SELECT id FROM Tweets WHERE user = ? AND id <= ?);`, nil, user, upTo)
+		n = conn.Changes()
+		return err
+	})
+	return n, errors.Wrap(err, "failed delete query")
+}
+
+// sourceName extracts the client name from the source of a tweet, which is
+// an HTML link like <a href="http://twitter.com" rel="nofollow">Twitter Web
+// Client</a>, or sometimes just the plain name.
+func sourceName(source string) string {
+	if i := strings.Index(source, ">"); strings.HasPrefix(source, "<a") && i >= 0 {
+		source = source[i+1:]
+		source = strings.TrimSuffix(source, "</a>")
+	}
+	return strings.TrimSpace(html.UnescapeString(source))
+}
+
+// parseTwitterTime parses the created_at format of the Twitter API, like
+// "Mon Jan 02 15:04:05 -0700 2006". The result is in UTC, so that the times
+// stored in the database can be compared as strings, see sqlTime.
+func parseTwitterTime(createdAt string) (time.Time, error) {
+	t, err := time.Parse(time.RubyDate, createdAt)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid created time %q", createdAt)
+	}
+	return t.UTC(), nil
+}
+
+// eventCreated returns the creation time of m if it's an event, or nil.
+func (c *Covfefe) eventCreated(m *Message) interface{} {
+	e, ok := m.decode(c.decoder).(*twitter.Event)
+	if !ok {
+		return nil
+	}
+	t, err := parseTwitterTime(e.CreatedAt)
+	if err != nil {
+		c.log.WithError(err).WithField("event", e.Event).Warning("Failed to parse event time")
+		return nil
 	}
 	return t
 }
+
+// setEventCreated fills the creation time of an event stored before it was
+// recorded, for example during a rescan.
+func (c *Covfefe) setEventCreated(m *Message) error {
+	created := c.eventCreated(m)
+	if created == nil {
+		return nil
+	}
+	return errors.Wrap(c.execSQL(m, `UPDATE Messages SET created = ? WHERE id = ? AND created IS NULL;`,
+		created, m.id), "failed update query")
+}
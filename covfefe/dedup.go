@@ -0,0 +1,74 @@
+package covfefe
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/valyala/fastjson"
+	"golang.org/x/crypto/blake2b"
+)
+
+// viewerFields are the fields of tweets and users that depend on the account
+// that received them, or on how they were delivered, rather than on the tweet.
+var viewerFields = map[string]bool{
+	"favorited":            true,
+	"retweeted":            true,
+	"current_user_retweet": true,
+	"following":            true,
+	"follow_request_sent":  true,
+	"notifications":        true,
+	"muting":               true,
+	"blocking":             true,
+	"blocked_by":           true,
+	"filter_level":         true,
+	"timestamp_ms":         true,
+}
+
+// messageKey returns the key that identifies duplicates of m in c.msgIDs. It's
+// the hash of the raw message, or with WithDedupTweets, of the normalized
+// tweet it carries, so that the copies received by different accounts match.
+func (c *Covfefe) messageKey(m *Message) [32]byte {
+	if c.dedupTweets {
+		if v := m.raw(); v != nil && v.Exists("id") && v.Exists("user") && !v.Exists("event") {
+			return blake2b.Sum256(normalizedJSON(nil, v))
+		}
+	}
+	return blake2b.Sum256(m.msg)
+}
+
+// normalizedJSON appends to dst the JSON encoding of v without viewerFields,
+// with object keys sorted, so that equivalent payloads encode the same.
+func normalizedJSON(dst []byte, v *fastjson.Value) []byte {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		o, _ := v.Object()
+		var keys []string
+		o.Visit(func(k []byte, _ *fastjson.Value) {
+			if !viewerFields[string(k)] {
+				keys = append(keys, string(k))
+			}
+		})
+		sort.Strings(keys)
+		dst = append(dst, '{')
+		for i, k := range keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = strconv.AppendQuote(dst, k)
+			dst = append(dst, ':')
+			dst = normalizedJSON(dst, o.Get(k))
+		}
+		return append(dst, '}')
+	case fastjson.TypeArray:
+		dst = append(dst, '[')
+		for i, e := range v.GetArray() {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = normalizedJSON(dst, e)
+		}
+		return append(dst, ']')
+	default:
+		return v.MarshalTo(dst)
+	}
+}
@@ -0,0 +1,173 @@
+package covfefe
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+	"github.com/valyala/fastjson"
+)
+
+// ExportFilter selects which tweets are exported by ExportTweets.
+type ExportFilter struct {
+	// Account, if not zero, selects only tweets observed by this account ID.
+	Account int64
+
+	// Since and Until, if not zero, select only tweets created in [Since, Until).
+	Since, Until time.Time
+
+	// IncludeDeleted selects also tweets that were deleted.
+	IncludeDeleted bool
+}
+
+// sqlTime formats t like the times stored in the Tweets table, which can then
+// be compared as strings.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// ExportTweets writes the archived tweets selected by filter to w as
+// newline-delimited JSON, in ID order. Each tweet is extracted from the raw
+// message it was first seen in, and gets a display_text field with the part of
+// its full text that Twitter displays, or all of it if that's unknown.
+func (c *Covfefe) ExportTweets(w io.Writer, filter ExportFilter) error {
+	var where []string
+	var args []interface{}
+	if filter.Account != 0 {
+		where = append(where, `EXISTS (SELECT 1 FROM json_each(Messages.account) WHERE value = ?)`)
+		args = append(args, filter.Account)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, `Tweets.created >= ?`)
+		args = append(args, sqlTime(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, `Tweets.created < ?`)
+		args = append(args, sqlTime(filter.Until))
+	}
+	if !filter.IncludeDeleted {
+		where = append(where, `Tweets.deleted IS NULL`)
+	}
+	query := `SELECT Tweets.id, Messages.json, Messages.compressed, Tweets.text,
+		Tweets.display_start, Tweets.display_end FROM Tweets
+		JOIN Messages ON Tweets.message = Messages.id`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY Tweets.id;`
+
+	bw := bufio.NewWriter(w)
+	var p fastjson.Parser
+	var a fastjson.Arena
+	var buf []byte
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+			id := stmt.ColumnInt64(0)
+			msg, err := storedJSON(stmt.ColumnReader(1), stmt.ColumnInt64(2) != 0)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read message for tweet %d", id)
+			}
+			v, err := p.ParseBytes(msg)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse message for tweet %d", id)
+			}
+			tweet := findTweet(v, id)
+			if tweet == nil {
+				return errors.Errorf("tweet %d not found in its message", id)
+			}
+			text := stmt.ColumnText(3)
+			if stmt.ColumnType(4) != sqlite.SQLITE_NULL && stmt.ColumnType(5) != sqlite.SQLITE_NULL {
+				r := twitter.Indices{stmt.ColumnInt(4), stmt.ColumnInt(5)}
+				text = entityText(text, r, codePoints)
+			}
+			a.Reset()
+			tweet.Set("display_text", a.NewString(text))
+			buf = tweet.MarshalTo(buf[:0])
+			buf = append(buf, '\n')
+			_, err = bw.Write(buf)
+			return err
+		}, args...)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to export tweets")
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// RawTweet returns the raw JSON object of an archived tweet, from TweetJSON if
+// it was stored there, see WithStoreTweetJSON, or else extracted from the
+// message it was stored from.
+func (c *Covfefe) RawTweet(id int64) ([]byte, error) {
+	var data []byte
+	var found bool
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT TweetJSON.json, Messages.json, Messages.compressed
+			FROM Tweets JOIN Messages ON Tweets.message = Messages.id
+			LEFT JOIN TweetJSON ON TweetJSON.tweet = Tweets.id WHERE Tweets.id = ?;`,
+			func(stmt *sqlite.Stmt) error {
+				found = true
+				if stmt.ColumnType(0) != sqlite.SQLITE_NULL {
+					data = []byte(stmt.ColumnText(0))
+					return nil
+				}
+				msg, err := storedJSON(stmt.ColumnReader(1), stmt.ColumnInt64(2) != 0)
+				if err != nil {
+					return errors.Wrapf(err, "failed to read message for tweet %d", id)
+				}
+				v, err := fastjson.ParseBytes(msg)
+				if err != nil {
+					return errors.Wrapf(err, "failed to parse message for tweet %d", id)
+				}
+				tweet := findTweet(v, id)
+				if tweet == nil {
+					return errors.Errorf("tweet %d not found in its message", id)
+				}
+				data = tweet.MarshalTo(nil)
+				return nil
+			}, id)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tweet")
+	}
+	if !found {
+		return nil, errors.Errorf("tweet %d not archived", id)
+	}
+	return data, nil
+}
+
+// ExportFollows writes the follow graph to w as CSV, with a header row and the
+// columns source_id, target_id, message_id and observed_at, in the order the
+// follows were first seen. observed_at is when the message was received, in
+// RFC 3339 format.
+func (c *Covfefe) ExportFollows(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"source_id", "target_id", "message_id", "observed_at"}); err != nil {
+		return errors.WithStack(err)
+	}
+	record := make([]string, 4)
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT Follows.follower, Follows.target, Follows.first_seen,
+			strftime('%Y-%m-%dT%H:%M:%SZ', Messages.received) FROM Follows
+			JOIN Messages ON Follows.first_seen = Messages.id
+			ORDER BY Follows.first_seen, Follows.rowid;`,
+			func(stmt *sqlite.Stmt) error {
+				record[0] = strconv.FormatInt(stmt.ColumnInt64(0), 10)
+				record[1] = strconv.FormatInt(stmt.ColumnInt64(1), 10)
+				record[2] = strconv.FormatInt(stmt.ColumnInt64(2), 10)
+				record[3] = stmt.ColumnText(3)
+				return cw.Write(record)
+			})
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to export follows")
+	}
+	cw.Flush()
+	return errors.WithStack(cw.Error())
+}
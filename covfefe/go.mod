@@ -14,7 +14,6 @@ require (
 	github.com/schollz/progressbar/v2 v2.9.1
 	github.com/sirupsen/logrus v1.3.0
 	github.com/stretchr/testify v1.3.0 // indirect
-	github.com/v2pro/plz v0.0.0-20180227161703-2d49b86ea382
 	github.com/valyala/fastjson v1.4.0
 	golang.org/x/crypto v0.0.0-20190123085648-057139ce5d2b
 	golang.org/x/sys v0.0.0-20190124100055-b90733256f2e // indirect
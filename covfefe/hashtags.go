@@ -0,0 +1,98 @@
+package covfefe
+
+import (
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+)
+
+// normalizeHashtag returns the form hashtags are indexed by: lowercase, and
+// without the leading hash sign. Twitter already normalizes tweet text to NFC.
+func normalizeHashtag(tag string) string {
+	tag = strings.TrimLeft(tag, "#＃")
+	return strings.ToLower(tag)
+}
+
+// processHashtags indexes the hashtags in tweet.
+func (c *Covfefe) processHashtags(m *Message, tweet *twitter.Tweet) (err error) {
+	e := entities(tweet)
+	if e == nil {
+		return nil
+	}
+	for _, h := range e.Hashtags {
+		tag := normalizeHashtag(h.Text)
+		if tag == "" {
+			continue
+		}
+		if herr := c.insertHashtag(tweet.ID, tag, m); herr != nil {
+			c.log.WithError(herr).WithField("message", m.id).Error("Failed to insert hashtag")
+			err = firstError(err, herr)
+		}
+	}
+	return err
+}
+
+// TweetsByHashtag returns the IDs of the archived tweets with the given
+// hashtag, in ID order. The tag is matched case-insensitively, with or without
+// the leading hash sign.
+func (c *Covfefe) TweetsByHashtag(tag string) ([]int64, error) {
+	var ids []int64
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT tweet FROM Hashtags WHERE tag = ? ORDER BY tweet;`,
+			func(stmt *sqlite.Stmt) error {
+				ids = append(ids, stmt.ColumnInt64(0))
+				return nil
+			}, normalizeHashtag(tag))
+	})
+	return ids, errors.Wrap(err, "failed select query")
+}
+
+// normalizeSymbol returns the form cashtags are indexed by: uppercase, and
+// without the leading dollar sign.
+func normalizeSymbol(symbol string) string {
+	symbol = strings.TrimLeft(symbol, "$＄")
+	return strings.ToUpper(symbol)
+}
+
+// processSymbols indexes the cashtags in tweet, like $AAPL. go-twitter doesn't
+// decode them, so they are read from the raw message, preferring the entities
+// of the extended tweet like entities does.
+func (c *Covfefe) processSymbols(m *Message, tweet *twitter.Tweet) (err error) {
+	v := m.rawTweet(tweet.ID)
+	if v == nil {
+		return nil
+	}
+	symbols := v.GetArray("entities", "symbols")
+	if v.Exists("extended_tweet", "entities") {
+		symbols = v.GetArray("extended_tweet", "entities", "symbols")
+	}
+	for _, s := range symbols {
+		symbol := normalizeSymbol(string(s.GetStringBytes("text")))
+		if symbol == "" {
+			continue
+		}
+		if serr := c.insertSymbol(tweet.ID, symbol, m); serr != nil {
+			c.log.WithError(serr).WithField("message", m.id).Error("Failed to insert symbol")
+			err = firstError(err, serr)
+		}
+	}
+	return err
+}
+
+// TweetsBySymbol returns the IDs of the archived tweets with the given
+// cashtag, in ID order. The symbol is matched case-insensitively, with or
+// without the leading dollar sign.
+func (c *Covfefe) TweetsBySymbol(symbol string) ([]int64, error) {
+	var ids []int64
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT tweet FROM Symbols WHERE symbol = ? ORDER BY tweet;`,
+			func(stmt *sqlite.Stmt) error {
+				ids = append(ids, stmt.ColumnInt64(0))
+				return nil
+			}, normalizeSymbol(symbol))
+	})
+	return ids, errors.Wrap(err, "failed select query")
+}
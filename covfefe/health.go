@@ -0,0 +1,31 @@
+package covfefe
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// markHandled records that a message was just handled successfully.
+func (c *Covfefe) markHandled() {
+	atomic.StoreInt64(&c.lastHandled, time.Now().UnixNano())
+}
+
+// HealthHandler returns an http.Handler that responds 200 OK if a message was
+// handled successfully within the staleness window set by WithHealthWindow,
+// and 503 Service Unavailable otherwise, to catch stalls that don't cause
+// errors. The window starts counting when the archive is opened.
+func (c *Covfefe) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last := time.Unix(0, atomic.LoadInt64(&c.lastHandled))
+		since := time.Since(last).Truncate(time.Second)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if since > c.healthWindow {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "stalled: last message handled %v ago\n", since)
+			return
+		}
+		fmt.Fprintf(w, "ok: last message handled %v ago\n", since)
+	})
+}
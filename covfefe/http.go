@@ -0,0 +1,387 @@
+package covfefe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultUserAgent identifies the archiver to the servers media is fetched
+// from, unless replaced with WithUserAgent.
+const defaultUserAgent = "covfefe (+https://github.com/FiloSottile/mostly-harmless/tree/master/covfefe)"
+
+// httpDo makes a request with the configured User-Agent and client, see
+// WithHTTPClientFunc. The whole request, including reading the body, is bounded
+// by ctx and c.requestTimeout, whose context is released when the body is closed.
+func (c *Covfefe) httpDo(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if err := c.limiter.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	var cancel context.CancelFunc
+	if c.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	client := c.httpClient
+	if c.clientFor != nil {
+		if hc := c.clientFor(req.URL.Host); hc != nil {
+			client = hc
+		}
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// mediaDeadline bounds the total time spent downloading a single file,
+// including all retries, so a stuck host can't hold a worker forever.
+const mediaDeadline = 5 * time.Minute
+
+// httpError is returned by httpGet for non-200 responses.
+type httpError struct {
+	url        string
+	status     string
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("error getting %s: %s", e.url, e.status)
+}
+
+// temporary reports whether the request might succeed if retried.
+func (e *httpError) temporary() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// overloaded reports whether the server is asking clients to back off.
+func (e *httpError) overloaded() bool {
+	return e.code == http.StatusTooManyRequests || e.code == http.StatusServiceUnavailable
+}
+
+// errMediaTooLarge is returned by httpGet for files over c.maxMediaBytes.
+var errMediaTooLarge = errors.New("media file too large")
+
+// httpGet fetches url into dst, retrying temporary failures, and returns the
+// Content-Type header of the response. dst is truncated before each attempt.
+// It gives up when ctx is done.
+func (c *Covfefe) httpGet(ctx context.Context, url string, dst *os.File) (string, error) {
+	deadline := time.Now().Add(mediaDeadline)
+	delay := 1 * time.Second
+	host := requestHost(url)
+	for attempt := 0; ; attempt++ {
+		if wait := c.breaker.wait(host); wait > 0 {
+			if time.Now().Add(wait).After(deadline) {
+				return "", errors.Errorf("giving up while downloads from %s are paused", host)
+			}
+			c.log.WithField("url", url).WithField("wait", wait).Debug("Waiting for paused host")
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if err := dst.Truncate(0); err != nil {
+			return "", errors.WithStack(err)
+		}
+		if _, err := dst.Seek(0, io.SeekStart); err != nil {
+			return "", errors.WithStack(err)
+		}
+		contentType, err := c.httpGetOnce(ctx, url, dst)
+		if c.breaker.record(host, err) {
+			c.metrics.breakerTrips.inc(host)
+			c.log.WithError(err).WithField("host", host).Warning("Pausing downloads from overloaded host")
+		}
+		if err == nil {
+			return contentType, nil
+		}
+		if err == errMediaTooLarge {
+			return "", err
+		}
+		if attempt >= c.mediaRetries || ctx.Err() != nil {
+			return "", errors.Wrapf(err, "giving up after %d attempts", attempt+1)
+		}
+		// Jitter the backoff, so that failed downloads don't all retry
+		// at the same time.
+		wait := jitter(delay)
+		if err, ok := err.(*httpError); ok {
+			if !err.temporary() {
+				return "", err
+			}
+			if err.retryAfter > wait {
+				wait = err.retryAfter
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return "", errors.Wrap(err, "giving up after reaching deadline")
+		}
+		c.log.WithError(err).WithField("url", url).WithField("wait", wait).Debug("Retrying download")
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Covfefe) httpGetOnce(ctx context.Context, url string, dst io.Writer) (string, error) {
+	start := time.Now()
+	defer func() { c.metrics.httpGetLatency.observe(secondsSince(start)) }()
+	res, err := c.httpDo(ctx, "GET", url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", &httpError{
+			url: url, status: res.Status, code: res.StatusCode,
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if c.maxMediaBytes > 0 && res.ContentLength > c.maxMediaBytes {
+		return "", errMediaTooLarge
+	}
+	body := io.Reader(res.Body)
+	if c.maxMediaBytes > 0 {
+		// Read one byte more than the limit, to tell if it was exceeded.
+		body = io.LimitReader(res.Body, c.maxMediaBytes+1)
+	}
+	n, err := io.Copy(dst, body)
+	c.metrics.bytesFetched.add(uint64(n))
+	if err != nil {
+		return "", err
+	}
+	if c.maxMediaBytes > 0 && n > c.maxMediaBytes {
+		return "", errMediaTooLarge
+	}
+	// A truncated file can still have a valid header, so check the length
+	// if the server sent one. It's -1 otherwise, also when decompressing.
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return "", errors.Errorf("truncated download: got %d of %d bytes", n, res.ContentLength)
+	}
+	return res.Header.Get("Content-Type"), nil
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can be
+// either a number of seconds or an HTTP date. It returns zero if absent or
+// invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// requestHost returns the host of rawurl, or the empty string if it's invalid.
+func requestHost(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+const (
+	// breakerThreshold is how many consecutive 429 or 503 responses from a
+	// host open its circuit.
+	breakerThreshold = 5
+	// breakerCooldown is how long downloads from a host are first paused
+	// for, before jitter. It doubles every time the circuit opens again
+	// without a success in between, up to breakerMaxCooldown.
+	breakerCooldown    = 30 * time.Second
+	breakerMaxCooldown = 10 * time.Minute
+)
+
+// hostBreaker is a circuit breaker with a separate circuit for each request
+// host. A circuit opens when the host keeps responding that it's overloaded,
+// and then downloads from it pause for a cooldown. The first request after
+// that is a probe: if it fails too, the circuit opens again right away. A nil
+// *hostBreaker never opens.
+type hostBreaker struct {
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures  int // consecutive overloaded responses
+	trips     int // times opened since the last success
+	openUntil time.Time
+}
+
+func newHostBreaker() *hostBreaker {
+	return &hostBreaker{hosts: make(map[string]*circuit)}
+}
+
+// wait returns how long until requests to host are allowed again, or zero.
+func (b *hostBreaker) wait(host string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.hosts[host]; ok {
+		if wait := time.Until(c.openUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// record updates the circuit of host with the result of a request, and
+// reports whether that opened it. Errors other than overloaded responses, like
+// network failures, don't change the circuit.
+func (b *hostBreaker) record(host string, err error) (opened bool) {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.hosts, host)
+		return false
+	}
+	if err, ok := err.(*httpError); !ok || !err.overloaded() {
+		return false
+	}
+	c, ok := b.hosts[host]
+	if !ok {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	if c.failures < breakerThreshold {
+		return false
+	}
+	cooldown := breakerMaxCooldown
+	if c.trips < 10 && breakerCooldown<<uint(c.trips) < breakerMaxCooldown {
+		cooldown = breakerCooldown << uint(c.trips)
+	}
+	c.trips++
+	c.openUntil = time.Now().Add(jitter(cooldown))
+	return true
+}
+
+// open returns 1 for each host with an open circuit, and 0 for the other hosts
+// that recently failed, for metrics.
+func (b *hostBreaker) open() map[string]float64 {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := make(map[string]float64, len(b.hosts))
+	for host, c := range b.hosts {
+		state[host] = 0
+		if time.Now().Before(c.openUntil) {
+			state[host] = 1
+		}
+	}
+	return state
+}
+
+// hostLimiter is a token bucket rate limiter with a separate bucket for each
+// request host. A nil *hostLimiter allows all requests.
+type hostLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHostLimiter(rate float64) *hostLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &hostLimiter{rate: rate, burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// wait blocks until a request to host is allowed, or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	// Take the token now, even if it will only be available in the future,
+	// so that concurrent callers queue up behind each other.
+	b.tokens--
+	delay := time.Duration(-b.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
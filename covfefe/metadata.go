@@ -0,0 +1,108 @@
+package covfefe
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// withoutMetadata returns the image in data without the metadata that can
+// identify where and with what it was taken, see WithStripMetadata. The image
+// itself is not re-encoded, the metadata segments are just dropped. mimeType
+// must be image/jpeg or image/png.
+func withoutMetadata(data []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return jpegWithoutMetadata(data)
+	case "image/png":
+		return pngWithoutMetadata(data)
+	default:
+		return nil, errors.Errorf("can't strip metadata from %q", mimeType)
+	}
+}
+
+// jpegMetadata are the JPEG markers of the segments dropped by
+// jpegWithoutMetadata: APP1 (EXIF, including GPS and camera details, and XMP),
+// APP12 (Ducky), APP13 (Photoshop and IPTC) and COM (comments). APP0 (JFIF),
+// APP2 (ICC color profiles) and APP14 (Adobe) are needed to display the image
+// correctly, and are kept.
+var jpegMetadata = map[byte]bool{0xe1: true, 0xec: true, 0xed: true, 0xfe: true}
+
+func jpegWithoutMetadata(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("missing JPEG start of image")
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	for p := 2; ; {
+		if p+2 > len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		if data[p] != 0xff {
+			return nil, errors.Errorf("invalid JPEG marker at offset %d", p)
+		}
+		marker := data[p+1]
+		switch {
+		case marker == 0xff: // fill byte
+			p++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			// Markers without a segment.
+			out = append(out, data[p:p+2]...)
+			p += 2
+			continue
+		case marker == 0xd9: // end of image
+			return append(out, data[p:p+2]...), nil
+		}
+		if p+4 > len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		end := p + 2 + int(binary.BigEndian.Uint16(data[p+2:]))
+		if end < p+4 || end > len(data) {
+			return nil, errors.Errorf("invalid JPEG segment at offset %d", p)
+		}
+		if marker == 0xda {
+			// Start of scan. What follows is image data, and metadata
+			// segments are only allowed before it.
+			return append(out, data[p:]...), nil
+		}
+		if !jpegMetadata[marker] {
+			out = append(out, data[p:end]...)
+		}
+		p = end
+	}
+}
+
+// pngMetadata are the PNG chunks dropped by pngWithoutMetadata. Text chunks
+// can carry XMP, as well as arbitrary comments.
+var pngMetadata = map[string]bool{
+	"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+func pngWithoutMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("missing PNG signature")
+	}
+	out := append(make([]byte, 0, len(data)), signature...)
+	for p := len(signature); ; {
+		// Length, type, data and CRC.
+		if p+12 > len(data) {
+			return nil, errors.New("truncated PNG")
+		}
+		length := uint64(binary.BigEndian.Uint32(data[p:]))
+		if length > uint64(len(data)-p-12) {
+			return nil, errors.Errorf("invalid PNG chunk at offset %d", p)
+		}
+		end := p + 12 + int(length)
+		typ := string(data[p+4 : p+8])
+		if !pngMetadata[typ] {
+			out = append(out, data[p:end]...)
+		}
+		if typ == "IEND" {
+			// Anything after the end of the image is dropped too.
+			return out, nil
+		}
+		p = end
+	}
+}
@@ -0,0 +1,85 @@
+package covfefe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func jpegSegment(marker byte, data string) []byte {
+	s := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(2+len(data)))
+	return append(s, data...)
+}
+
+func pngChunk(typ, data string) []byte {
+	c := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	c = append(c, typ...)
+	c = append(c, data...)
+	return append(c, 0, 0, 0, 0) // CRC, which is not checked
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestWithoutMetadata(t *testing.T) {
+	soi, eoi := []byte{0xff, 0xd8}, []byte{0xff, 0xd9}
+	jfif := jpegSegment(0xe0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	exif := jpegSegment(0xe1, "Exif\x00\x00GPS and camera")
+	comment := jpegSegment(0xfe, "a comment")
+	icc := jpegSegment(0xe2, "ICC_PROFILE\x00")
+	scan := concat(jpegSegment(0xda, "\x01\x01\x00\x00\x3f\x00"), []byte("\x12\xff\x00\x34"), eoi)
+
+	const signature = "\x89PNG\r\n\x1a\n"
+	ihdr := pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+	idat := pngChunk("IDAT", "pixels")
+	iend := pngChunk("IEND", "")
+
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+		want     []byte // nil if an error is expected
+	}{
+		{"jpeg", "image/jpeg", concat(soi, jfif, exif, icc, comment, scan),
+			concat(soi, jfif, icc, scan)},
+		{"jpeg without metadata", "image/jpeg", concat(soi, jfif, scan), concat(soi, jfif, scan)},
+		{"jpeg fill bytes", "image/jpeg", concat(soi, []byte{0xff}, exif, scan), concat(soi, scan)},
+		{"jpeg without scan", "image/jpeg", concat(soi, exif, eoi), concat(soi, eoi)},
+		{"png", "image/png", concat([]byte(signature), ihdr, pngChunk("tEXt", "Comment\x00hi"),
+			pngChunk("eXIf", "MM\x00\x2a"), idat, pngChunk("tIME", "\x07\xe3\x0c\x1f\x00\x00\x00"), iend),
+			concat([]byte(signature), ihdr, idat, iend)},
+		{"png trailing data", "image/png", concat([]byte(signature), ihdr, idat, iend, []byte("junk")),
+			concat([]byte(signature), ihdr, idat, iend)},
+
+		{"empty jpeg", "image/jpeg", nil, nil},
+		{"not a jpeg", "image/jpeg", []byte(signature), nil},
+		{"jpeg truncated after start", "image/jpeg", soi, nil},
+		{"jpeg truncated segment", "image/jpeg", concat(soi, exif[:len(exif)-3]), nil},
+		{"jpeg truncated length", "image/jpeg", concat(soi, exif[:3]), nil},
+		{"jpeg short segment length", "image/jpeg", concat(soi, []byte{0xff, 0xe1, 0x00, 0x01}, scan), nil},
+		{"jpeg invalid marker", "image/jpeg", concat(soi, []byte{0x00, 0xe1}, scan), nil},
+		{"empty png", "image/png", nil, nil},
+		{"not a png", "image/png", concat(soi, scan), nil},
+		{"png without end", "image/png", concat([]byte(signature), ihdr, idat), nil},
+		{"png truncated chunk", "image/png", concat([]byte(signature), ihdr, idat[:len(idat)-1]), nil},
+		{"png huge chunk length", "image/png",
+			concat([]byte(signature), []byte("\xff\xff\xff\xffIDAT\x00\x00\x00\x00"), iend), nil},
+		{"gif", "image/gif", []byte("GIF89a"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withoutMetadata(tt.data, tt.mimeType)
+			switch {
+			case tt.want == nil && err == nil:
+				t.Errorf("got %q, want an error", got)
+			case tt.want != nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !bytes.Equal(got, tt.want):
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
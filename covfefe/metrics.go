@@ -0,0 +1,220 @@
+package covfefe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics are exposed in the Prometheus text format by MetricsHandler. We
+// only need a handful of counters, so they are implemented here rather than
+// pulling in the client library and its dependencies.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type counter struct {
+	name, help string
+	v          uint64
+}
+
+func (c *counter) inc()         { atomic.AddUint64(&c.v, 1) }
+func (c *counter) add(n uint64) { atomic.AddUint64(&c.v, n) }
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.v))
+}
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name, help, label string
+
+	mu sync.Mutex
+	v  map[string]uint64
+}
+
+func (c *counterVec) inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.v == nil {
+		c.v = make(map[string]uint64)
+	}
+	c.v[value]++
+}
+
+// snapshot returns a copy of the current values.
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := make(map[string]uint64, len(c.v))
+	for value, n := range c.v {
+		v[value] = n
+	}
+	return v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, value := range sortedKeys(c.v) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, value, c.v[value])
+	}
+}
+
+// gaugeVecFunc is a gauge partitioned by the value of a single label, whose
+// values are computed by f when the metrics are served.
+type gaugeVecFunc struct {
+	name, help, label string
+	f                 func() map[string]float64
+}
+
+func (g *gaugeVecFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	if g.f == nil {
+		return
+	}
+	v := g.f()
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, value := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, value, v[value])
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, in increasing order
+
+	mu     sync.Mutex
+	counts []uint64 // not cumulative, len(buckets)+1
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets)+1)
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var total uint64
+	for i, le := range h.buckets {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, le, total)
+	}
+	if h.counts != nil {
+		total += h.counts[len(h.buckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, total)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, total)
+}
+
+type metrics struct {
+	tweets           counter
+	users            counter
+	events           counter
+	deletions        counter
+	mediaDownloaded  counter
+	mediaFailed      counter
+	bytesFetched     counter
+	httpGetLatency   histogram
+	unknownEvents    counterVec
+	droppedProtected counterVec
+	breakerTrips     counterVec
+	breakerOpen      gaugeVecFunc
+	published        counter
+	publishFailed    counter
+	publishDropped   counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		tweets:          counter{name: "covfefe_tweets_total", help: "New tweets archived."},
+		users:           counter{name: "covfefe_users_total", help: "New users, or new handles, names or bios of users, archived."},
+		events:          counter{name: "covfefe_events_total", help: "Events processed."},
+		deletions:       counter{name: "covfefe_deletions_total", help: "Tweet deletions processed."},
+		mediaDownloaded: counter{name: "covfefe_media_downloaded_total", help: "Media files saved."},
+		mediaFailed:     counter{name: "covfefe_media_failed_total", help: "Media downloads that failed."},
+		bytesFetched:    counter{name: "covfefe_fetched_bytes_total", help: "Bytes of media downloaded."},
+		httpGetLatency: histogram{
+			name:    "covfefe_http_get_duration_seconds",
+			help:    "Latency of media download requests.",
+			buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		unknownEvents: counterVec{
+			name: "covfefe_unknown_events_total", label: "event",
+			help: "Events of unknown type, dropped as protected.",
+		},
+		droppedProtected: counterVec{
+			name: "covfefe_dropped_protected_total", label: "reason",
+			help: "Messages dropped because they are protected or possibly private.",
+		},
+		breakerTrips: counterVec{
+			name: "covfefe_circuit_breaker_trips_total", label: "host",
+			help: "Times downloads from a host were paused because it was overloaded.",
+		},
+		breakerOpen: gaugeVecFunc{
+			name: "covfefe_circuit_breaker_open", label: "host",
+			help: "Whether downloads from a host that recently failed are paused.",
+		},
+		published:      counter{name: "covfefe_published_total", help: "Tweets sent to the Publisher."},
+		publishFailed:  counter{name: "covfefe_publish_failed_total", help: "Tweets the Publisher failed to send."},
+		publishDropped: counter{name: "covfefe_publish_dropped_total", help: "Tweets dropped because the publish queue was full."},
+	}
+}
+
+func (m *metrics) all() []metric {
+	return []metric{
+		&m.tweets, &m.users, &m.events, &m.deletions,
+		&m.mediaDownloaded, &m.mediaFailed, &m.bytesFetched, &m.httpGetLatency,
+		&m.unknownEvents, &m.droppedProtected, &m.breakerTrips, &m.breakerOpen,
+		&m.published, &m.publishFailed, &m.publishDropped,
+	}
+}
+
+// MetricsHandler returns an http.Handler that serves the processing metrics in
+// the Prometheus text exposition format.
+func (c *Covfefe) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		for _, m := range c.metrics.all() {
+			m.writeTo(bw)
+		}
+		bw.Flush()
+	})
+}
+
+func secondsSince(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
@@ -0,0 +1,574 @@
+package covfefe
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/pkg/errors"
+)
+
+// migrations are the steps that build the database schema, applied in order by
+// migrate. The position in the list is the schema version. Never change or
+// remove a migration that might have been applied, append a new one instead.
+var migrations = []func(conn *sqlite.Conn) error{
+	migration1,
+	migration2,
+	migration3,
+	migration4,
+	migration5,
+	migration6,
+	migration7,
+	migration8,
+	migration9,
+	migration10,
+	migration11,
+	migration12,
+	migration13,
+	migration14,
+	migration15,
+	migration16,
+	migration17,
+	migration18,
+	migration19,
+	migration20,
+	migration21,
+	migration22,
+	migration23,
+	migration24,
+	migration25,
+	migration26,
+	migration27,
+	migration28,
+	migration29,
+	migration30,
+	migration31,
+	migration32,
+	migration33,
+}
+
+// migrate brings the database schema up to date. Each migration runs in its
+// own transaction, and the applied versions are tracked in SchemaMigrations.
+// The schema is created even in dry run mode.
+func (c *Covfefe) migrate() error {
+	return errors.Wrap(c.withConn(func(conn *sqlite.Conn) error {
+		if err := sqliteutil.ExecScript(conn, `
+			CREATE TABLE IF NOT EXISTS SchemaMigrations (
+				version INTEGER PRIMARY KEY,
+				applied DATETIME DEFAULT (DATETIME('now'))
+			);`); err != nil {
+			return err
+		}
+		version, err := sqliteutil.ResultInt64(conn.Prep(
+			"SELECT COALESCE(MAX(version), 0) FROM SchemaMigrations;"))
+		if err != nil {
+			return err
+		}
+		for v := int(version); v < len(migrations); v++ {
+			if err := applyMigration(conn, v+1, migrations[v]); err != nil {
+				return errors.Wrapf(err, "migration %d failed", v+1)
+			}
+			c.log.WithField("version", v+1).Debug("Applied migration")
+		}
+		return nil
+	}), "failed to initialize database")
+}
+
+func applyMigration(conn *sqlite.Conn, version int, m func(conn *sqlite.Conn) error) (err error) {
+	defer sqliteutil.Save(conn)(&err)
+	if err := m(conn); err != nil {
+		return err
+	}
+	return sqliteutil.Exec(conn, "INSERT INTO SchemaMigrations (version) VALUES (?);", nil, version)
+}
+
+// migration1 is the schema from before versioning, so it must work both on an
+// empty database and on one that already has some of these tables.
+func migration1(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE IF NOT EXISTS Messages (
+			id INTEGER PRIMARY KEY,
+			received DATETIME DEFAULT (DATETIME('now')),
+			json TEXT NOT NULL,
+			account TEXT NOT NULL -- JSON array of IDs
+		);
+		CREATE TABLE IF NOT EXISTS Tweets (
+			id INTEGER PRIMARY KEY,
+			created DATETIME NOT NULL,
+			user INTEGER NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			deleted INTEGER REFERENCES Messages(id)
+		);
+		CREATE TABLE IF NOT EXISTS Users (
+			id INTEGER NOT NULL,
+			handle TEXT NOT NULL,
+			name TEXT NOT NULL,
+			bio TEXT NOT NULL,
+			first_seen INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (id, handle, name, bio) ON CONFLICT IGNORE
+		);
+		CREATE TABLE IF NOT EXISTS Follows (
+			follower INTEGER NOT NULL,
+			target INTEGER NOT NULL,
+			first_seen INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (target, follower) ON CONFLICT IGNORE
+		);
+		CREATE TABLE IF NOT EXISTS Quotes (
+			tweet INTEGER NOT NULL,
+			quoted INTEGER NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, quoted) ON CONFLICT IGNORE
+		);
+		CREATE INDEX IF NOT EXISTS QuotesQuoted ON Quotes (quoted);
+		CREATE TABLE IF NOT EXISTS Retweets (
+			tweet INTEGER PRIMARY KEY ON CONFLICT IGNORE,
+			original INTEGER NOT NULL,
+			user INTEGER NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);
+		CREATE INDEX IF NOT EXISTS RetweetsOriginal ON Retweets (original);
+		CREATE TABLE IF NOT EXISTS Media (
+			id INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			hash TEXT NOT NULL, -- hex SHA-256 of the contents
+			name TEXT NOT NULL, -- file name in the media folder
+			UNIQUE (id, hash) ON CONFLICT IGNORE
+		);
+		CREATE INDEX IF NOT EXISTS MediaHash ON Media (hash);
+		CREATE TABLE IF NOT EXISTS ProfileImages (
+			user INTEGER NOT NULL,
+			kind TEXT NOT NULL, -- avatar or banner
+			url TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			name TEXT NOT NULL,
+			first_seen INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (url, hash) ON CONFLICT IGNORE
+		);
+		CREATE INDEX IF NOT EXISTS ProfileImagesUser ON ProfileImages (user);
+		CREATE INDEX IF NOT EXISTS ProfileImagesName ON ProfileImages (name);
+		CREATE TABLE IF NOT EXISTS URLs (
+			tweet INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			expanded TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, url) ON CONFLICT IGNORE
+		);
+		CREATE TABLE IF NOT EXISTS ResolvedURLs (
+			url TEXT PRIMARY KEY ON CONFLICT IGNORE,
+			final TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			resolved DATETIME DEFAULT (DATETIME('now'))
+		);
+		CREATE TABLE IF NOT EXISTS MediaErrors (
+			media INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 1,
+			last_attempt DATETIME DEFAULT (DATETIME('now')),
+			PRIMARY KEY (media, url)
+		);
+		CREATE TABLE IF NOT EXISTS Polls (
+			tweet INTEGER NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			observed DATETIME NOT NULL,
+			choice INTEGER NOT NULL, -- 1-based position
+			label TEXT NOT NULL,
+			votes INTEGER NOT NULL,
+			ends DATETIME,
+			final INTEGER NOT NULL,
+			UNIQUE (tweet, message, choice) ON CONFLICT IGNORE
+		);
+		CREATE TABLE IF NOT EXISTS Places (
+			id TEXT PRIMARY KEY ON CONFLICT IGNORE,
+			name TEXT NOT NULL,
+			full_name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			country TEXT NOT NULL,
+			country_code TEXT NOT NULL,
+			bounding_box TEXT, -- GeoJSON
+			first_seen INTEGER NOT NULL REFERENCES Messages(id)
+		);
+		CREATE TABLE IF NOT EXISTS Locations (
+			tweet INTEGER PRIMARY KEY ON CONFLICT IGNORE,
+			place TEXT REFERENCES Places(id),
+			longitude REAL,
+			latitude REAL,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);
+		CREATE VIRTUAL TABLE IF NOT EXISTS TweetsText USING fts5 (text); -- rowid is the tweet ID
+		CREATE TABLE IF NOT EXISTS AltTexts (
+			media INTEGER PRIMARY KEY ON CONFLICT IGNORE,
+			tweet INTEGER NOT NULL,
+			text TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);
+		CREATE TABLE IF NOT EXISTS RescanState (
+			last_message INTEGER NOT NULL -- single row, while a rescan is in progress
+		);`)
+}
+
+func migration2(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Hashtags (
+			tweet INTEGER NOT NULL,
+			tag TEXT NOT NULL, -- see normalizeHashtag
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, tag) ON CONFLICT IGNORE
+		);
+		CREATE INDEX HashtagsTag ON Hashtags (tag);`)
+}
+
+func migration3(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Mentions (
+			tweet INTEGER NOT NULL,
+			user INTEGER NOT NULL,
+			handle TEXT NOT NULL, -- as of the tweet, since handles change
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, user) ON CONFLICT IGNORE
+		);
+		CREATE INDEX MentionsUser ON Mentions (user);`)
+}
+
+func migration4(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE DirectMessages (
+			id INTEGER PRIMARY KEY ON CONFLICT IGNORE,
+			created DATETIME NOT NULL,
+			sender INTEGER NOT NULL,
+			recipient INTEGER NOT NULL,
+			text TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);`)
+}
+
+func migration5(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE TweetAccounts (
+			tweet INTEGER NOT NULL,
+			account INTEGER NOT NULL,
+			first_seen INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, account) ON CONFLICT IGNORE
+		);
+		CREATE INDEX TweetAccountsAccount ON TweetAccounts (account);
+		CREATE TABLE UserAccounts (
+			user INTEGER NOT NULL,
+			account INTEGER NOT NULL,
+			first_seen INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (user, account) ON CONFLICT IGNORE
+		);
+		CREATE INDEX UserAccountsAccount ON UserAccounts (account);`)
+}
+
+// migration6 adds the name of the client a tweet was posted from, see
+// sourceName. It's NULL for tweets archived before it.
+func migration6(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `ALTER TABLE Tweets ADD COLUMN source TEXT;`)
+}
+
+func migration7(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE PendingMedia (
+			media INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			PRIMARY KEY (media, url) ON CONFLICT IGNORE
+		);`)
+}
+
+// migration8 adds the language code of tweets, as detected by Twitter. It's
+// NULL for tweets archived before it, and "und" if undetermined.
+func migration8(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Tweets ADD COLUMN lang TEXT;
+		CREATE INDEX TweetsLang ON Tweets (lang);`)
+}
+
+// migration9 adds the history of withholding notices, one row per country per
+// notice. observed is when the notice was received, and the same country can
+// appear again in later notices.
+func migration9(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE StatusWithheld (
+			status INTEGER NOT NULL,
+			user INTEGER NOT NULL,
+			country TEXT NOT NULL,
+			observed DATETIME,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (status, country, message) ON CONFLICT IGNORE
+		);
+		CREATE INDEX StatusWithheldStatus ON StatusWithheld (status);
+		CREATE TABLE UserWithheld (
+			user INTEGER NOT NULL,
+			country TEXT NOT NULL,
+			observed DATETIME,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (user, country, message) ON CONFLICT IGNORE
+		);
+		CREATE INDEX UserWithheldUser ON UserWithheld (user);`)
+}
+
+// migration10 adds the complete text of tweets, see fullText. It's NULL for
+// tweets archived before it, until the next rescan.
+func migration10(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `ALTER TABLE Tweets ADD COLUMN text TEXT;`)
+}
+
+// migration11 records the type, resolution and size of stored media, so that
+// a larger copy can replace it, see saveMedia. They are NULL for media stored
+// before it, and width and height are zero if unknown.
+func migration11(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Media ADD COLUMN type TEXT;
+		ALTER TABLE Media ADD COLUMN width INTEGER;
+		ALTER TABLE Media ADD COLUMN height INTEGER;
+		ALTER TABLE Media ADD COLUMN size INTEGER;
+		CREATE INDEX MediaID ON Media (id);`)
+}
+
+// migration12 adds the limit notices of the streaming API. track is the number
+// of undelivered tweets since the start of the connection.
+func migration12(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE StreamLimits (
+			track INTEGER NOT NULL,
+			observed DATETIME,
+			message INTEGER NOT NULL UNIQUE ON CONFLICT IGNORE REFERENCES Messages(id)
+		);`)
+}
+
+// migration13 adds a record of each deletion notice and the accounts that
+// received it, while the tweet itself is only flagged in Tweets.deleted.
+func migration13(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Deletions (
+			tweet INTEGER NOT NULL,
+			user INTEGER NOT NULL,
+			account INTEGER NOT NULL,
+			observed DATETIME,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, account) ON CONFLICT IGNORE
+		);
+		CREATE INDEX DeletionsUser ON Deletions (user);`)
+}
+
+// migration14 adds the history of likes. added is 1 for a favorite event, and
+// 0 for an unfavorite one.
+func migration14(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Favorites (
+			user INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			added INTEGER NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (user, tweet, message) ON CONFLICT IGNORE
+		);
+		CREATE INDEX FavoritesTweet ON Favorites (tweet);`)
+}
+
+// migration15 adds the parsed creation time of events, which is NULL for other
+// messages. Events stored before this migration get it with a rescan.
+func migration15(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Messages ADD COLUMN created DATETIME;
+		CREATE INDEX MessagesCreated ON Messages (created);`)
+}
+
+// migration16 marks the messages whose json is gzip compressed, see
+// WithCompressMessages.
+func migration16(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `ALTER TABLE Messages ADD COLUMN compressed INTEGER NOT NULL DEFAULT 0;`)
+}
+
+// migration17 adds whether a tweet was marked as possibly sensitive. It's NULL
+// for tweets stored before this migration, until a rescan.
+func migration17(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `ALTER TABLE Tweets ADD COLUMN sensitive INTEGER;`)
+}
+
+// migration18 adds the snapshots of tweet counts recorded with
+// WithTrackEngagement, one for each message a tweet was seen in.
+func migration18(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Engagement (
+			tweet INTEGER NOT NULL,
+			favorites INTEGER NOT NULL,
+			retweets INTEGER NOT NULL,
+			replies INTEGER,
+			quotes INTEGER,
+			observed DATETIME,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, message) ON CONFLICT IGNORE
+		);`)
+}
+
+// migration19 adds the index of cashtags, like Hashtags.
+func migration19(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE Symbols (
+			tweet INTEGER NOT NULL,
+			symbol TEXT NOT NULL, -- see normalizeSymbol
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, symbol) ON CONFLICT IGNORE
+		);
+		CREATE INDEX SymbolsSymbol ON Symbols (symbol);`)
+}
+
+// migration20 adds the ID of the first tweet of the thread of each tweet. It's
+// NULL for tweets stored before this migration, until a rescan.
+func migration20(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Tweets ADD COLUMN conversation INTEGER;
+		CREATE INDEX TweetsConversation ON Tweets (conversation);`)
+}
+
+// migration21 adds the metadata of media from the tweet entities, which is
+// available before the files are downloaded. Unlike Media, which has a row per
+// stored file, it has one per media ID. duration_ms and the aspect ratio are
+// NULL for photos, and the dimensions are those of the largest size served.
+func migration21(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE MediaInfo (
+			media INTEGER PRIMARY KEY ON CONFLICT IGNORE,
+			tweet INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			width INTEGER,
+			height INTEGER,
+			duration_ms INTEGER,
+			aspect_width INTEGER,
+			aspect_height INTEGER,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);`)
+}
+
+// migration22 adds the images of link preview cards, see WithCardImages.
+func migration22(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE CardImages (
+			tweet INTEGER NOT NULL,
+			url TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			name TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (tweet, url) ON CONFLICT IGNORE
+		);
+		CREATE INDEX CardImagesName ON CardImages (name);`)
+}
+
+// migration23 adds the favorite and retweet counts of tweets, as of when they
+// were first seen, or last seen with UpdateConflicts, and the ID of the last
+// message that updated them. The counts are NULL for tweets stored before this
+// migration, until a rescan.
+func migration23(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Tweets ADD COLUMN favorites INTEGER;
+		ALTER TABLE Tweets ADD COLUMN retweets INTEGER;
+		ALTER TABLE Tweets ADD COLUMN updated INTEGER REFERENCES Messages(id);`)
+}
+
+// migration24 flags tweets stored from a compact form, without entities, see
+// compactTweet. Tweets stored before this migration are assumed complete.
+func migration24(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `ALTER TABLE Tweets ADD COLUMN compact INTEGER NOT NULL DEFAULT 0;`)
+}
+
+// migration25 adds the raw JSON of tweets, see WithStoreTweetJSON. Upgrades of
+// compact tweets replace it.
+func migration25(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE TweetJSON (
+			tweet INTEGER PRIMARY KEY ON CONFLICT REPLACE,
+			json TEXT NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id)
+		);`)
+}
+
+// migration26 adds the tweets users had pinned, recorded when they change. A
+// tweet of zero means that the user had none.
+func migration26(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE PinnedTweets (
+			user INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			observed DATETIME NOT NULL,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (user, tweet, message) ON CONFLICT IGNORE
+		);
+		CREATE INDEX PinnedTweetsUser ON PinnedTweets (user, message);`)
+}
+
+// migration27 adds the edit history of tweets, linking every version of an
+// edited tweet to the initial one. The latest known version is flagged.
+func migration27(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE EditHistory (
+			initial INTEGER NOT NULL,
+			tweet INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			latest INTEGER NOT NULL DEFAULT 0,
+			message INTEGER NOT NULL REFERENCES Messages(id),
+			UNIQUE (initial, tweet) ON CONFLICT IGNORE
+		);
+		CREATE INDEX EditHistoryTweet ON EditHistory (tweet);`)
+}
+
+// migration28 adds the Wayback Machine snapshots of resolved links, see
+// WithWayback. WaybackURLs is keyed by expanded URL and survives rescans, while
+// URLs.wayback is filled in from it.
+func migration28(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE URLs ADD COLUMN wayback TEXT;
+		CREATE TABLE WaybackURLs (
+			url TEXT PRIMARY KEY ON CONFLICT REPLACE,
+			wayback TEXT NOT NULL,
+			archived DATETIME DEFAULT (DATETIME('now'))
+		);`)
+}
+
+// migration29 adds the part of the text of tweets that Twitter displays,
+// without the leading reply mentions and trailing media links, as offsets in
+// code points into Tweets.text. They are NULL if unknown.
+func migration29(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Tweets ADD COLUMN display_start INTEGER;
+		ALTER TABLE Tweets ADD COLUMN display_end INTEGER;`)
+}
+
+// migration30 adds the scope of withholding notices, which says whether a
+// single status or the whole account was withheld.
+func migration30(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE StatusWithheld ADD COLUMN scope TEXT NOT NULL DEFAULT 'status';
+		ALTER TABLE UserWithheld ADD COLUMN scope TEXT NOT NULL DEFAULT 'user';`)
+}
+
+// migration31 adds the tweets that the REST API reported as unavailable when
+// crawled, with the HTTP status, so that they are not fetched again. It's not
+// derived from Messages, and survives rescans.
+func migration31(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		CREATE TABLE UnavailableTweets (
+			id INTEGER PRIMARY KEY ON CONFLICT REPLACE,
+			status INTEGER NOT NULL,
+			checked DATETIME DEFAULT (DATETIME('now'))
+		);`)
+}
+
+// migration32 adds who quoted whom to Quotes, from the authors of the tweets or
+// from quoted_tweet events. They are NULL if unknown.
+func migration32(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Quotes ADD COLUMN user INTEGER;
+		ALTER TABLE Quotes ADD COLUMN quoted_user INTEGER;`)
+}
+
+// migration33 adds the tweet and user that tweets reply to, which are NULL for
+// tweets that are not replies. Tweets archived earlier get them on a rescan.
+func migration33(conn *sqlite.Conn) error {
+	return sqliteutil.ExecScript(conn, `
+		ALTER TABLE Tweets ADD COLUMN reply_to INTEGER;
+		ALTER TABLE Tweets ADD COLUMN reply_to_user INTEGER;
+		ALTER TABLE Tweets ADD COLUMN reply_to_handle TEXT;
+		CREATE INDEX TweetsReplyTo ON Tweets (reply_to);
+		CREATE INDEX TweetsReplyToUser ON Tweets (reply_to_user);`)
+}
@@ -0,0 +1,41 @@
+package covfefe
+
+import (
+	"encoding/json"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// processPlace records the place and exact coordinates a tweet was geotagged
+// with, if any.
+func (c *Covfefe) processPlace(m *Message, tweet *twitter.Tweet) error {
+	if tweet.Place == nil && tweet.Coordinates == nil {
+		return nil
+	}
+	log := c.log.WithField("message", m.id).WithField("tweet", tweet.ID)
+
+	var place, lon, lat interface{}
+	if p := tweet.Place; p != nil && p.ID != "" {
+		var bbox []byte
+		if p.BoundingBox != nil {
+			bbox, _ = json.Marshal(p.BoundingBox)
+		}
+		if err := c.insertPlace(p, string(bbox), m); err != nil {
+			log.WithError(err).Error("Failed to insert place")
+			return err
+		}
+		place = p.ID
+	}
+	if tweet.Coordinates != nil && tweet.Coordinates.Type == "Point" {
+		// GeoJSON order is longitude, latitude.
+		lon, lat = tweet.Coordinates.Coordinates[0], tweet.Coordinates.Coordinates[1]
+	}
+	if place == nil && lon == nil {
+		return nil
+	}
+	if err := c.insertLocation(tweet.ID, place, lon, lat, m); err != nil {
+		log.WithError(err).Error("Failed to insert location")
+		return err
+	}
+	return nil
+}
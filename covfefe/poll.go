@@ -0,0 +1,77 @@
+package covfefe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/valyala/fastjson"
+)
+
+type poll struct {
+	choices []pollChoice
+	ends    time.Time
+	final   bool
+}
+
+type pollChoice struct {
+	label string
+	votes int64
+}
+
+// processPoll stores a snapshot of the poll attached to tweet, if any. It runs
+// every time a tweet is seen, since the vote counts change over time.
+func (c *Covfefe) processPoll(m *Message, tweet *twitter.Tweet) error {
+	raw := m.rawTweet(tweet.ID)
+	if raw == nil || !raw.Exists("card") {
+		return nil
+	}
+	p := parsePoll(raw.Get("card"))
+	if p == nil {
+		return nil
+	}
+	var ends interface{}
+	if !p.ends.IsZero() {
+		ends = p.ends
+	}
+	for i, choice := range p.choices {
+		if err := c.insertPollChoice(tweet.ID, i+1, choice.label,
+			choice.votes, ends, p.final, m); err != nil {
+			c.log.WithError(err).WithField("message", m.id).Error("Failed to insert poll")
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePoll extracts a poll from the card object of a tweet, or returns nil if
+// the card is not a poll.
+func parsePoll(card *fastjson.Value) *poll {
+	// Poll cards are named like poll2choice_text_only or poll4choice_image.
+	if !strings.HasPrefix(string(card.GetStringBytes("name")), "poll") {
+		return nil
+	}
+	values := card.Get("binding_values")
+	str := func(key string) string {
+		return string(values.GetStringBytes(key, "string_value"))
+	}
+
+	p := &poll{final: values.GetBool("counts_are_final", "boolean_value")}
+	for i := 1; ; i++ {
+		label := str(fmt.Sprintf("choice%d_label", i))
+		if label == "" {
+			break
+		}
+		votes, _ := strconv.ParseInt(str(fmt.Sprintf("choice%d_count", i)), 10, 64)
+		p.choices = append(p.choices, pollChoice{label: label, votes: votes})
+	}
+	if len(p.choices) == 0 {
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, str("end_datetime_utc")); err == nil {
+		p.ends = t
+	}
+	return p
+}
@@ -1,39 +1,489 @@
 package covfefe
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"io/ioutil"
+	"mime"
 	"os"
-	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
+	"crawshaw.io/sqlite"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/h2non/filetype"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fastjson"
 )
 
 type Message struct {
 	account *twitter.User
 	msg     []byte
 	id      int64
+	depth   int // how many reply parents were crawled to reach this message
+	nesting int // how many tweets processTweet is currently nested in
+
+	// observers are the IDs of the accounts that received the message,
+	// when read back from the database, where account is not known.
+	observers []int64
+
+	parsed  *fastjson.Value // lazily parsed msg, see rawTweet
+	decoded interface{}     // lazily decoded msg, see decode
+
+	conn  *sqlite.Conn   // transaction of Handle, see withMessageConn
+	after []func() error // see afterCommit
 }
 
-func (c *Covfefe) processTweet(m *Message, tweet *twitter.Tweet) {
-	new, err := c.insertTweet(tweet, m.id)
+// afterCommit schedules f to run once the transaction of Handle is committed.
+// It's skipped if the transaction is rolled back.
+func (m *Message) afterCommit(f func() error) {
+	m.after = append(m.after, f)
+}
+
+// fetching reports whether downloads and crawls should be started, which they
+// aren't during a rescan or if disabled with WithFetching.
+func (c *Covfefe) fetching() bool {
+	return c.fetch && !c.rescan
+}
+
+// inBackground runs f in a goroutine tracked by c.wg once m is committed, so
+// that downloads and lookups derived from a message that is rolled back never
+// start, and don't compete with its transaction for the database.
+func (c *Covfefe) inBackground(m *Message, f func()) {
+	m.afterCommit(func() error {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			f()
+		}()
+		return nil
+	})
+}
+
+// processTweet stores tweet and everything derived from it. Failures are
+// logged as they happen, and the first one is returned.
+func (c *Covfefe) processTweet(m *Message, tweet *twitter.Tweet) error {
+	if m.nesting >= c.maxNesting {
+		// Retweets and quotes are processed recursively, and a malformed
+		// message, or a cyclic one built by a custom Decoder, could nest
+		// them without bound.
+		c.log.WithField("tweet", tweet.ID).WithField("message", m.id).
+			Warning("Reached maximum tweet nesting")
+		return nil
+	}
+	m.nesting++
+	defer func() { m.nesting-- }()
+	if tweet.User == nil {
+		// Without a user there's no telling if the tweet is protected, see
+		// isProtected. This can happen with retweeted or quoted tweets.
+		c.log.WithField("tweet", tweet.ID).WithField("message", m.id).
+			Warning("Dropped tweet without user")
+		return nil
+	}
+	if c.excludedUsers[tweet.User.ID] {
+		c.log.WithField("tweet", tweet.ID).WithField("message", m.id).Debug("Skipped tweet of excluded user")
+		return nil
+	}
+	if tweet.RetweetedStatus != nil && c.skipRetweetWrappers {
+		return c.processRetweetWrapper(m, tweet)
+	}
+	compact := compactTweet(m.rawTweet(tweet.ID))
+	new, err := c.store.insertTweet(tweet, conversationID(m, tweet), compact, m)
 	if err != nil {
-		log.WithFields(log.Fields{
+		c.log.WithFields(logrus.Fields{
 			"err": err, "message": m.id, "tweet": tweet.ID,
 		}).Error("Failed to insert tweet")
-		return
+		return err
+	}
+	if c.tweetIDs != nil && !c.dryRun && !compact {
+		// Only once it's committed, as a rollback would drop the tweet.
+		// Compact tweets are left out, so that they can be upgraded.
+		m.afterCommit(func() error {
+			c.tweetIDs.Add(tweet.ID, struct{}{})
+			return nil
+		})
+	}
+	err = c.processPoll(m, tweet)
+	err = firstError(err, c.processObservers(m, tweet))
+	if c.trackEngagement {
+		err = firstError(err, c.processEngagement(m, tweet))
 	}
 	if !new {
-		return
+		return err
+	}
+	c.metrics.tweets.inc()
+
+	err = firstError(err, c.processUser(m, tweet.User))
+	err = firstError(err, c.processURLs(m, tweet))
+	err = firstError(err, c.processHashtags(m, tweet))
+	err = firstError(err, c.processSymbols(m, tweet))
+	err = firstError(err, c.processMentions(m, tweet))
+	err = firstError(err, c.processPlace(m, tweet))
+	err = firstError(err, c.processAltText(m, tweet))
+	err = firstError(err, c.processQuote(m, tweet))
+	err = firstError(err, c.processEditHistory(m, tweet))
+	if c.storeTweetJSON {
+		err = firstError(err, c.processTweetJSON(m, tweet))
+	}
+	c.processCardImage(m, tweet)
+	if c.onTweet != nil && !c.rescan {
+		m.afterCommit(func() error {
+			c.onTweet(tweet, m.id)
+			return nil
+		})
+	}
+	if c.publisher != nil && !c.rescan {
+		c.publishTweet(m, tweet)
+	}
+
+	media := tweetMedia(tweet)
+	err = firstError(err, c.processMediaInfo(m, tweet.ID, media))
+	if c.skipSensitiveMedia && tweet.PossiblySensitive && len(media) != 0 {
+		c.log.WithField("tweet", tweet.ID).Debug("Skipped sensitive media")
+		media = nil
+	}
+	if downloads := c.mediaDownloads(tweet.ID, media); len(downloads) != 0 && c.fetching() {
+		if c.recordMediaOnly {
+			for _, d := range downloads {
+				if perr := c.insertPendingMedia(d, m); perr != nil {
+					c.log.WithError(perr).WithField("message", m.id).Error("Failed to insert pending media")
+					err = firstError(err, perr)
+				}
+			}
+		} else {
+			c.inBackground(m, func() {
+				for _, d := range downloads {
+					c.downloadMedia(c.ctx, d.tweet, d.media, d.url)
+				}
+			})
+		}
+	}
+
+	if rt := tweet.RetweetedStatus; rt != nil {
+		if rerr := c.insertRetweet(tweet.ID, rt.ID, tweet.User.ID, m); rerr != nil {
+			c.log.WithError(rerr).WithField("message", m.id).Error("Failed to insert retweet")
+			err = firstError(err, rerr)
+		}
+		err = firstError(err, c.processTweet(m, rt))
+	}
+	if tweet.QuotedStatus != nil {
+		err = firstError(err, c.processTweet(m, tweet.QuotedStatus))
+	} else if tweet.QuotedStatusID != 0 {
+		err = firstError(err, c.crawlQuote(m, tweet))
+	}
+	if tweet.InReplyToStatusID != 0 {
+		err = firstError(err, c.crawlParent(m, tweet))
+	}
+	// TODO: crawl non-embedded linked tweets
+	return err
+}
+
+// conversationID returns the ID of the first tweet of the thread of tweet, from
+// the conversation_id field of newer payloads, which go-twitter doesn't decode.
+// Without it, a tweet that is not a reply starts its own thread, and zero is
+// returned for replies.
+func conversationID(m *Message, tweet *twitter.Tweet) int64 {
+	if v := m.rawTweet(tweet.ID); v != nil {
+		if id := v.GetInt64("conversation_id"); id != 0 {
+			return id
+		}
+		if id, err := strconv.ParseInt(string(v.GetStringBytes("conversation_id_str")), 10, 64); err == nil {
+			return id
+		}
 	}
+	if tweet.InReplyToStatusID == 0 {
+		return tweet.ID
+	}
+	return 0
+}
+
+// processEditHistory records the versions of an edited tweet, from the
+// edit_history_tweet_ids field of v2 payloads, or the edit_history object of
+// v1.1 ones, which go-twitter doesn't decode. Each edit is a new tweet with a
+// new ID, and lists all the versions up to itself. Tweets that were never
+// edited have a single version, and are not recorded.
+func (c *Covfefe) processEditHistory(m *Message, tweet *twitter.Tweet) error {
+	raw := m.rawTweet(tweet.ID)
+	if raw == nil {
+		return nil
+	}
+	ids := raw.GetArray("edit_history_tweet_ids")
+	if ids == nil {
+		ids = raw.GetArray("edit_history", "edit_tweet_ids")
+	}
+	var versions []int64
+	for _, v := range ids {
+		id, err := strconv.ParseInt(string(v.GetStringBytes()), 10, 64)
+		if err != nil {
+			id = v.GetInt64()
+		}
+		if id != 0 {
+			versions = append(versions, id)
+		}
+	}
+	if len(versions) < 2 {
+		return nil
+	}
+	if err := c.insertEditHistory(versions[0], versions, m); err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert edit history")
+		return err
+	}
+	return nil
+}
+
+// excludedMessage reports whether msg is authored by an excluded user, or is
+// an event by or targeting one, see WithExcludedUsers.
+func (c *Covfefe) excludedMessage(msg interface{}) bool {
+	if len(c.excludedUsers) == 0 {
+		return false
+	}
+	switch obj := msg.(type) {
+	case *twitter.Tweet:
+		return obj.User != nil && c.excludedUsers[obj.User.ID]
+	case *twitter.Event:
+		return obj.Source != nil && c.excludedUsers[obj.Source.ID] ||
+			obj.Target != nil && c.excludedUsers[obj.Target.ID]
+	case *twitter.StatusDeletion:
+		return c.excludedUsers[obj.UserID]
+	}
+	return false
+}
+
+// sampledMessage reports whether msg is kept by the sampling of WithSampleRate.
+// The original of a kept retweet or quote is stored regardless of its own ID,
+// so deletions are always kept, as deletedTweet ignores unknown tweets, and so
+// are events about a tweet that is already stored.
+func (c *Covfefe) sampledMessage(m *Message, msg interface{}) (bool, error) {
+	if c.sampleRate >= 1 {
+		return true, nil
+	}
+	switch obj := msg.(type) {
+	case *twitter.Tweet:
+		return sampled(obj.ID, c.sampleRate), nil
+	case *twitter.Event:
+		if obj.TargetObject == nil || sampled(obj.TargetObject.ID, c.sampleRate) {
+			return true, nil
+		}
+		return c.tweetExists(m, obj.TargetObject.ID)
+	}
+	return true, nil
+}
 
-	c.processUser(m, tweet.User)
+// sampled reports whether the tweet with the given ID falls in the sampled
+// fraction rate. The ID is hashed with the SplitMix64 finalizer, since its own
+// bits depend on when and where the tweet was posted. The hash must never
+// change, or archives would keep a different sample after upgrading.
+func sampled(id int64, rate float64) bool {
+	h := uint64(id)
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return float64(h>>11)/(1<<53) < rate
+}
 
+// processRetweetWrapper records only the retweet edge and the retweeter of a
+// retweet, and processes the original tweet, see WithSkipRetweetWrappers.
+func (c *Covfefe) processRetweetWrapper(m *Message, tweet *twitter.Tweet) error {
+	rt := tweet.RetweetedStatus
+	err := c.insertRetweet(tweet.ID, rt.ID, tweet.User.ID, m)
+	if err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert retweet")
+	}
+	err = firstError(err, c.processUser(m, tweet.User))
+	return firstError(err, c.processTweet(m, rt))
+}
+
+// processMentions records the users mentioned in tweet.
+func (c *Covfefe) processMentions(m *Message, tweet *twitter.Tweet) (err error) {
+	e := entities(tweet)
+	if e == nil {
+		return nil
+	}
+	for _, u := range e.UserMentions {
+		if merr := c.insertMention(tweet.ID, u.ID, u.ScreenName, m); merr != nil {
+			c.log.WithError(merr).WithField("message", m.id).Error("Failed to insert mention")
+			err = firstError(err, merr)
+		}
+	}
+	return err
+}
+
+// processQuote records that tweet quotes another one. The quoted tweet might
+// not be embedded, for example if it was deleted, but its ID is still known.
+func (c *Covfefe) processQuote(m *Message, tweet *twitter.Tweet) error {
+	quoted, quotedUser := tweet.QuotedStatusID, int64(0)
+	if q := tweet.QuotedStatus; q != nil {
+		quoted = q.ID
+		if q.User != nil {
+			quotedUser = q.User.ID
+		}
+	}
+	if quoted == 0 {
+		return nil
+	}
+	var user int64
+	if tweet.User != nil {
+		user = tweet.User.ID
+	}
+	if err := c.insertQuote(tweet.ID, quoted, user, quotedUser, m); err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert quote")
+		return err
+	}
+	return nil
+}
+
+// processQuoteEvent records the quote of a quoted_tweet event, where the
+// source quoted a tweet of the target, and the target object is the quote. It
+// runs even if the quote was already archived, which might have been without
+// knowing its authors. Events involving protected users were dropped by
+// isProtected.
+func (c *Covfefe) processQuoteEvent(m *Message, e *twitter.Event) error {
+	if e.Source == nil || e.Target == nil || e.TargetObject == nil {
+		return nil
+	}
+	quote := e.TargetObject
+	quoted := quote.QuotedStatusID
+	if quote.QuotedStatus != nil {
+		quoted = quote.QuotedStatus.ID
+	}
+	if quoted == 0 {
+		c.log.WithField("tweet", quote.ID).WithField("message", m.id).Debug(
+			"Skipped quoted_tweet event without the quoted tweet")
+		return nil
+	}
+	if err := c.insertQuote(quote.ID, quoted, e.Source.ID, e.Target.ID, m); err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert quote")
+		return err
+	}
+	return nil
+}
+
+// processEngagement records a snapshot of the counts of tweet. Like
+// processObservers, it runs every time a tweet is seen. The reply and quote
+// counts are NULL if the message doesn't include them.
+func (c *Covfefe) processEngagement(m *Message, tweet *twitter.Tweet) error {
+	var replies, quotes interface{}
+	if v := m.rawTweet(tweet.ID); v != nil {
+		if v.Exists("reply_count") {
+			replies = tweet.ReplyCount
+		}
+		if v.Exists("quote_count") {
+			quotes = tweet.QuoteCount
+		}
+	}
+	if err := c.insertEngagement(tweet.ID, tweet.FavoriteCount, tweet.RetweetCount,
+		replies, quotes, m); err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert engagement")
+		return err
+	}
+	return nil
+}
+
+// processObservers records which accounts saw tweet and its author. It runs
+// every time a tweet is seen, since other accounts might see it later.
+func (c *Covfefe) processObservers(m *Message, tweet *twitter.Tweet) (err error) {
+	for _, account := range m.accounts() {
+		if oerr := c.insertTweetAccount(tweet.ID, account, m); oerr != nil {
+			c.log.WithError(oerr).WithField("message", m.id).Error("Failed to insert tweet account")
+			err = firstError(err, oerr)
+		}
+		if oerr := c.insertUserAccount(tweet.User.ID, account, m); oerr != nil {
+			c.log.WithError(oerr).WithField("message", m.id).Error("Failed to insert user account")
+			err = firstError(err, oerr)
+		}
+	}
+	return err
+}
+
+// accounts returns the IDs of the accounts that received the message.
+func (m *Message) accounts() []int64 {
+	if m.account != nil {
+		return []int64{m.account.ID}
+	}
+	return m.observers
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mediaDownload is a file to fetch for a media entity.
+type mediaDownload struct {
+	media, tweet int64
+	url          string
+}
+
+// processTweetJSON stores the raw JSON object of tweet on its own. If it can't
+// be found in the message, for example because a custom Decoder understood a
+// different format, the go-twitter type is marshaled instead.
+func (c *Covfefe) processTweetJSON(m *Message, tweet *twitter.Tweet) error {
+	var data []byte
+	if v := m.rawTweet(tweet.ID); v != nil {
+		data = v.MarshalTo(nil)
+	} else {
+		var err error
+		if data, err = json.Marshal(tweet); err != nil {
+			return errors.Wrapf(err, "failed to marshal tweet %d", tweet.ID)
+		}
+	}
+	if err := c.insertTweetJSON(tweet.ID, data, m); err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert tweet JSON")
+		return err
+	}
+	return nil
+}
+
+// publishTweet queues tweet to be sent to the Publisher once m is committed.
+// The JSON is marshaled now, as m can't be used after Handle returns.
+func (c *Covfefe) publishTweet(m *Message, tweet *twitter.Tweet) {
+	var payload []byte
+	if v := m.rawTweet(tweet.ID); v != nil {
+		payload = v.MarshalTo(nil)
+	} else {
+		var err error
+		if payload, err = json.Marshal(tweet); err != nil {
+			c.log.WithError(err).WithField("tweet", tweet.ID).Warning("Failed to marshal tweet to publish")
+			return
+		}
+	}
+	m.afterCommit(func() error {
+		c.publish(tweet.ID, payload)
+		return nil
+	})
+}
+
+// compactTweet reports whether a raw tweet is in a compact form, like some
+// event targets, which lacks entities or is truncated without its full text.
+// Those are flagged in Tweets.compact, see UpgradeCompact.
+func compactTweet(v *fastjson.Value) bool {
+	if v == nil {
+		return false
+	}
+	if !v.Exists("entities") {
+		return true
+	}
+	return v.GetBool("truncated") && !v.Exists("extended_tweet") && !v.Exists("full_text")
+}
+
+// tweetMedia returns the media attached to tweet, preferring the extended
+// entities, which list all of them, and those of the extended tweet.
+func tweetMedia(tweet *twitter.Tweet) []twitter.MediaEntity {
 	var media []twitter.MediaEntity
 	if tweet.Entities != nil {
 		media = tweet.Entities.Media
@@ -49,80 +499,521 @@ func (c *Covfefe) processTweet(m *Message, tweet *twitter.Tweet) {
 			media = tweet.ExtendedTweet.ExtendedEntities.Media
 		}
 	}
-	if len(media) != 0 && !c.rescan {
-		c.wg.Add(1)
-		go func() {
-			for _, m := range media {
-				if m.SourceStatusID != 0 {
-					// We'll find this media attached to the retweet.
-					continue
-				}
-				log := log.WithFields(log.Fields{
-					"url": m.MediaURLHttps, "media": m.ID, "tweet": tweet.ID,
-				})
-				body, err := c.httpGet(m.MediaURLHttps)
-				if err != nil {
-					log.WithError(err).Error("Failed to download media")
-					continue
-				}
-				if err := c.saveMedia(body, m.ID); err != nil {
-					log.WithError(err).Error("Failed to save media")
-					continue
-				}
-				// TODO: archive videos?
+	return media
+}
+
+// processMediaInfo stores the dimensions of the media attached to tweet, and
+// the duration and aspect ratio of videos and GIFs, as reported by Twitter.
+// Unknown values are stored as NULL.
+func (c *Covfefe) processMediaInfo(m *Message, tweet int64, media []twitter.MediaEntity) (err error) {
+	for _, e := range media {
+		var width, height, duration, aspectWidth, aspectHeight interface{}
+		if size := e.Sizes.Large; size.Width != 0 && size.Height != 0 {
+			width, height = size.Width, size.Height
+		}
+		if e.Type == "video" || e.Type == "animated_gif" {
+			if e.VideoInfo.DurationMillis != 0 {
+				duration = e.VideoInfo.DurationMillis
 			}
-			c.wg.Done()
-		}()
+			if ar := e.VideoInfo.AspectRatio; ar[0] != 0 && ar[1] != 0 {
+				aspectWidth, aspectHeight = ar[0], ar[1]
+			}
+		}
+		if ierr := c.insertMediaInfo(e.ID, tweet, e.Type, width, height,
+			duration, aspectWidth, aspectHeight, m); ierr != nil {
+			c.log.WithError(ierr).WithField("message", m.id).Error("Failed to insert media info")
+			err = firstError(err, ierr)
+		}
 	}
+	return err
+}
 
-	if tweet.RetweetedStatus != nil {
-		c.processTweet(m, tweet.RetweetedStatus)
+// mediaDownloads returns the files to fetch for the media attached to tweet:
+// the image, or the thumbnail and the best variant of videos and GIFs.
+func (c *Covfefe) mediaDownloads(tweet int64, media []twitter.MediaEntity) []mediaDownload {
+	var res []mediaDownload
+	for _, m := range media {
+		if m.SourceStatusID != 0 {
+			// We'll find this media attached to the retweet.
+			continue
+		}
+		res = append(res, mediaDownload{media: m.ID, tweet: tweet, url: m.MediaURLHttps})
+		if m.Type != "video" && m.Type != "animated_gif" {
+			continue
+		}
+		v := bestVideoVariant(m.VideoInfo.Variants)
+		if v == nil {
+			c.log.WithFields(logrus.Fields{
+				"media": m.ID, "tweet": tweet, "type": m.Type,
+			}).Warning("No usable video variant")
+			continue
+		}
+		c.log.WithFields(logrus.Fields{
+			"media": m.ID, "tweet": tweet, "url": v.URL, "bitrate": v.Bitrate,
+		}).Debug("Selected video variant")
+		res = append(res, mediaDownload{media: m.ID, tweet: tweet, url: v.URL})
 	}
-	if tweet.QuotedStatus != nil {
-		c.processTweet(m, tweet.QuotedStatus)
+	return res
+}
+
+// downloadMedia fetches and saves a media file. Failures are logged and
+// recorded in MediaErrors, to be retried, and returned for callers that keep
+// count. If ctx is done before the download starts, it's abandoned and
+// ctx.Err() is returned.
+func (c *Covfefe) downloadMedia(ctx context.Context, tweet, id int64, url string) error {
+	log := c.log.WithFields(logrus.Fields{
+		"url": url, "media": id, "tweet": tweet,
+	})
+	select {
+	case c.mediaSem <- struct{}{}:
+		defer func() { <-c.mediaSem }()
+	case <-ctx.Done():
+		log.Warning("Abandoned media download")
+		return ctx.Err()
+	}
+	c.downloads.Store(url, tweet)
+	defer c.downloads.Delete(url)
+
+	f, contentType, err := c.download(ctx, url)
+	if err != nil {
+		log.WithError(err).Error("Failed to download media")
+		c.metrics.mediaFailed.inc()
+		c.recordMediaError(id, tweet, url, err)
+		return err
+	}
+	defer removeTemp(f)
+	if err := c.saveMedia(f, contentType, id, tweet, url); err != nil {
+		log.WithError(err).Error("Failed to save media")
+		c.metrics.mediaFailed.inc()
+		c.recordMediaError(id, tweet, url, err)
+		return err
+	}
+	if err := c.clearMediaError(id, url); err != nil {
+		log.WithError(err).Error("Failed to clear media error")
+	}
+	return nil
+}
+
+func (c *Covfefe) recordMediaError(id, tweet int64, url string, err error) {
+	if err := c.insertMediaError(id, tweet, url, err.Error()); err != nil {
+		c.log.WithError(err).WithField("media", id).Error("Failed to record media error")
 	}
-	// TODO: crawl thread, non-embedded linked tweets
 }
 
-func (c *Covfefe) saveMedia(data []byte, id int64) error {
-	t, err := filetype.Match(data)
+// maxMediaAttempts is how many times retryFailedMedia tries a download before
+// giving up on it. Every attempt includes c.mediaRetries retries.
+const maxMediaAttempts = 10
+
+// retryFailedMedia attempts again the downloads that failed previously, as
+// recorded in the MediaErrors table. Successful ones are removed from it.
+func (c *Covfefe) retryFailedMedia() {
+	failed, err := c.failedMedia(maxMediaAttempts)
 	if err != nil {
-		return errors.WithStack(err)
+		c.log.WithError(err).Error("Failed to list media errors")
+		return
+	}
+	if len(failed) == 0 {
+		return
 	}
-	name := filepath.Join(c.mediaPath, fmt.Sprintf("%d.%s", id, t.Extension))
-	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	c.log.WithField("count", len(failed)).Info("Retrying failed media downloads")
+	for _, f := range failed {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.downloadMedia(c.ctx, f.tweet, f.media, f.url)
+	}
+}
+
+// DownloadPendingMedia fetches the media recorded while WithRecordMediaOnly
+// was enabled, and returns when they were all attempted. Failed downloads are
+// retried like any other, at the next Run. See BackfillMedia.
+func (c *Covfefe) DownloadPendingMedia() error {
+	return c.BackfillMedia(c.ctx)
+}
+
+// bestVideoVariant returns the highest bitrate MP4 variant, or nil if there
+// are none. Other formats, like HLS playlists, can't be archived as a file.
+func bestVideoVariant(variants []twitter.VideoVariant) *twitter.VideoVariant {
+	var best *twitter.VideoVariant
+	for i, v := range variants {
+		if v.ContentType != "video/mp4" {
+			continue
+		}
+		if best == nil || v.Bitrate > best.Bitrate {
+			best = &variants[i]
+		}
+	}
+	return best
+}
+
+// mediaExtensions maps the file types that can be saved as media to the
+// extension they are stored with. Anything else, like an HTML error or CAPTCHA
+// page served with a 200, is rejected.
+var mediaExtensions = map[string]string{
+	"image/jpeg":      "jpg",
+	"image/png":       "png",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+	"video/quicktime": "mov",
+}
+
+// download fetches url to a temporary file, to keep memory use flat even for
+// large videos. The caller must dispose of the file with removeTemp.
+func (c *Covfefe) download(ctx context.Context, url string) (*os.File, string, error) {
+	f, err := ioutil.TempFile("", "covfefe-media-")
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	contentType, err := c.httpGet(ctx, url, f)
+	if err != nil {
+		removeTemp(f)
+		return nil, "", err
+	}
+	return f, contentType, nil
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// mediaFile is the result of inspectMedia.
+type mediaFile struct {
+	mime string
+	ext  string
+	hash string
+	size int64
+
+	// width and height are zero if unknown, see mediaResolution.
+	width, height int
+}
+
+// largerThan reports whether m is a better copy than o, comparing resolution
+// if both are known, and file size otherwise.
+func (m *mediaFile) largerThan(o *mediaFile) bool {
+	if m.width*m.height > 0 && o.width*o.height > 0 {
+		return m.width*m.height > o.width*o.height
+	}
+	return m.size > o.size
+}
+
+// videoResolution matches the resolution in the path of video variants, like
+// https://video.twimg.com/ext_tw_video/1/pu/vid/1280x720/abc.mp4.
+var videoResolution = regexp.MustCompile(`/(\d+)x(\d+)/`)
+
+// mediaResolution fills in the width and height of mf, from the image header
+// or from the URL of a video. f is left at the start.
+func mediaResolution(mf *mediaFile, f io.ReadSeeker, url string) error {
+	if strings.HasPrefix(mf.mime, "video/") {
+		if m := videoResolution.FindStringSubmatch(url); m != nil {
+			mf.width, _ = strconv.Atoi(m[1])
+			mf.height, _ = strconv.Atoi(m[2])
+		}
+		return nil
+	}
+	// WebP is not supported by the standard library, and is compared by size.
+	if cfg, _, err := image.DecodeConfig(f); err == nil {
+		mf.width, mf.height = cfg.Width, cfg.Height
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return errors.WithStack(err)
+}
+
+// inspectMedia detects the type of a downloaded file and hashes it. The type
+// must be one of mediaExtensions, and agree with contentType, the Content-Type
+// header it was served with, if any. f is left at the start.
+func inspectMedia(f io.ReadSeeker, contentType string) (*mediaFile, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The file type can be detected from the first few hundred bytes.
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.WithStack(err)
+	}
+	t, err := filetype.Match(header[:n])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// filetype's own extensions are not consistent (jpg, but also "unknown"
+	// or empty), so use ours, which are also what file names end in.
+	ext := mediaExtensions[t.MIME.Value]
+	if ext == "" {
+		return nil, errors.Errorf("unexpected media type %q (extension %q, Content-Type %q)",
+			t.MIME.Value, t.Extension, contentType)
+	}
+	if ct, _, err := mime.ParseMediaType(contentType); err == nil &&
+		ct != "application/octet-stream" && !strings.HasPrefix(ct, t.MIME.Type+"/") {
+		return nil, errors.Errorf("media type %q does not match Content-Type %q", t.MIME.Value, contentType)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
-	if _, err := f.Write(data); err != nil {
-		return errors.WithStack(err)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
 	}
-	return errors.WithStack(f.Close())
+	return &mediaFile{
+		mime: t.MIME.Value, ext: ext,
+		hash: hex.EncodeToString(h.Sum(nil)), size: size,
+	}, nil
 }
 
-func (c *Covfefe) processUser(m *Message, user *twitter.User) {
-	if err := c.insertUser(user, m.id); err != nil {
-		log.WithError(err).WithField("message", m.id).Error("Failed to insert user")
+// saveMedia stores a downloaded media file, unless a copy is already stored.
+// If a smaller copy of the same media ID and kind (image or video) is stored,
+// like a resized image, this one replaces it in the Media table, although the
+// smaller file is left in the store. Otherwise, this one is dropped.
+func (c *Covfefe) saveMedia(f io.ReadSeeker, contentType string, id, tweet int64, url string) error {
+	mf, err := inspectMedia(f, contentType)
+	if err != nil {
+		return err
+	}
+	if c.stripMetadata && (mf.mime == "image/jpeg" || mf.mime == "image/png") {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		data, err = withoutMetadata(data, mf.mime)
+		if err != nil {
+			return errors.Wrap(err, "failed to strip metadata")
+		}
+		// The hash and size are of the file that is stored.
+		r := bytes.NewReader(data)
+		if mf, err = inspectMedia(r, contentType); err != nil {
+			return err
+		}
+		f = r
+	}
+	if len(c.mediaProcessors) != 0 {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, p := range c.mediaProcessors {
+			if data, err = p.Process(id, data, mf.mime); err != nil {
+				return errors.Wrap(err, "failed to process media")
+			}
+		}
+		// The processed file might be in a different format.
+		r := bytes.NewReader(data)
+		if mf, err = inspectMedia(r, ""); err != nil {
+			return errors.Wrap(err, "processed media")
+		}
+		f = r
 	}
+	if err := mediaResolution(mf, f, url); err != nil {
+		return err
+	}
+	hash := mf.hash
+	log := c.log.WithFields(logrus.Fields{
+		"media": id, "tweet": tweet, "hash": hash, "type": mf.mime,
+	})
+	if c.dryRun {
+		log.WithField("size", mf.size).Info("Dry run: would save media")
+		return nil
+	}
+	oldName, old, err := c.storedMedia(id, mf.mime)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if old.hash == hash || !mf.largerThan(old) {
+			log.WithField("name", oldName).Debug("Same or larger media already stored")
+			return nil
+		}
+		log.WithFields(logrus.Fields{
+			"old": fmt.Sprintf("%dx%d, %d bytes", old.width, old.height, old.size),
+			"new": fmt.Sprintf("%dx%d, %d bytes", mf.width, mf.height, mf.size),
+		}).Info("Upgrading media to larger copy")
+	}
+	name, err := c.mediaByHash(hash)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		log.WithField("name", name).Debug("Duplicate media")
+	} else {
+		// Stored files are not necessarily overwritten, see
+		// OverwritePolicy, so a larger copy needs a different name.
+		name = c.mediaNamer(id, mediaTime(tweet, id), mf.ext)
+		if old != nil {
+			name = upgradedName(name, hash, mf.ext)
+		}
+		if err := c.media.Put(name, f); err != nil {
+			return err
+		}
+		c.metrics.mediaDownloaded.inc()
+	}
+	if old != nil {
+		if err := c.deleteMedia(id, old.hash); err != nil {
+			return err
+		}
+	}
+	return c.insertMedia(id, tweet, mf, name)
+}
+
+// purgeMedia removes the stored media files of a deleted tweet, unless they are
+// also the media of other tweets. The files are removed from the store only
+// after the deletion is committed.
+func (c *Covfefe) purgeMedia(m *Message, tweet int64) error {
+	names, err := c.unsharedMedia(m, tweet)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := c.deleteMediaFile(m, name); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 || c.dryRun {
+		return nil
+	}
+	m.afterCommit(func() error {
+		for _, name := range names {
+			log := c.log.WithField("tweet", tweet).WithField("name", name)
+			if err := c.media.(mediaDeleter).Delete(name); err != nil {
+				// The file is orphaned, as it's not in Media anymore.
+				log.WithError(err).Error("Failed to purge media")
+				continue
+			}
+			log.Info("Purged media of deleted tweet")
+		}
+		return nil
+	})
+	return nil
+}
+
+func (c *Covfefe) processUser(m *Message, user *twitter.User) error {
+	if user == nil || c.excludedUsers[user.ID] {
+		return nil
+	}
+	new, err := c.store.insertUser(user, m)
+	if err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert user")
+		return err
+	}
+	if new {
+		c.metrics.users.inc()
+	}
+	for _, account := range m.accounts() {
+		if err := c.insertUserAccount(user.ID, account, m); err != nil {
+			c.log.WithError(err).WithField("message", m.id).Error("Failed to insert user account")
+			return err
+		}
+	}
+	if err := c.processPinnedTweets(m, user); err != nil {
+		return err
+	}
+	c.processProfileImages(m, user)
 	// Deprecated and removed, thankfully. It would break deduplication.
 	// if user.Following {
 	// 	if err := c.insertFollow(m.account.ID, user.ID, m.id); err != nil {
-	// 		log.WithError(err).WithField("message", m.id).Error("Failed to insert follow")
+	// 		c.log.WithError(err).WithField("message", m.id).Error("Failed to insert follow")
 	// 	}
 	// }
+	return nil
+}
+
+// processPinnedTweets records the tweets user had pinned, if the message says,
+// and they changed since the last observation. go-twitter doesn't decode them,
+// so they are read from the raw JSON. A user with no pinned tweet is recorded
+// with tweet zero.
+func (c *Covfefe) processPinnedTweets(m *Message, user *twitter.User) error {
+	raw := m.rawUser(user.ID)
+	var pinned []int64
+	switch {
+	case raw == nil:
+		return nil
+	case raw.Exists("pinned_tweet_ids_str"):
+		for _, v := range raw.GetArray("pinned_tweet_ids_str") {
+			if id, err := strconv.ParseInt(string(v.GetStringBytes()), 10, 64); err == nil {
+				pinned = append(pinned, id)
+			}
+		}
+	case raw.Exists("pinned_tweet_ids"):
+		for _, v := range raw.GetArray("pinned_tweet_ids") {
+			pinned = append(pinned, v.GetInt64())
+		}
+	default:
+		return nil
+	}
+	if len(pinned) == 0 {
+		pinned = []int64{0}
+	}
+
+	last, err := c.lastPinnedTweets(m, user.ID)
+	if err != nil {
+		c.log.WithError(err).WithField("message", m.id).Error("Failed to look up pinned tweets")
+		return err
+	}
+	if sameIDs(last, pinned) {
+		return nil
+	}
+	for _, tweet := range pinned {
+		if err := c.insertPinnedTweet(user.ID, tweet, m); err != nil {
+			c.log.WithError(err).WithField("message", m.id).Error("Failed to insert pinned tweet")
+			return err
+		}
+	}
+	return nil
 }
 
-func isProtected(message interface{}) bool {
+// sameIDs reports whether a and b contain the same IDs, in any order.
+func sameIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[int64]int)
+	for _, id := range a {
+		seen[id]++
+	}
+	for _, id := range b {
+		if seen[id] == 0 {
+			return false
+		}
+		seen[id]--
+	}
+	return true
+}
+
+func (c *Covfefe) isProtected(msg *Message, message interface{}) bool {
+	return c.protectedReason(msg, message) != ""
+}
+
+// protectedReason returns why message should be dropped as protected, like
+// "protected_user" or "list_event", or the empty string if it can be archived.
+// The reasons are the labels of the dropped protected messages metric.
+func (c *Covfefe) protectedReason(msg *Message, message interface{}) string {
 	switch m := message.(type) {
+	case *twitter.DirectMessage:
+		// DMs are always private, so they are only archived on request.
+		// The ones in the database were, so rescans keep them.
+		if !c.directMessages && !c.rescan {
+			return "direct_message"
+		}
 	case *twitter.Tweet:
-		if m.User.Protected {
-			return true
+		// Some malformed or compact payloads have no user. When in doubt...
+		if m.User == nil {
+			return "no_user"
+		}
+		if c.hiddenUser(m.User) {
+			return "protected_user"
+		}
+		if limitedAudience(msg.rawTweet(m.ID)) {
+			return "limited_audience"
 		}
 	case *twitter.Event:
-		if (m.Source != nil && m.Source.Protected) ||
-			(m.Target != nil && m.Target.Protected) ||
-			(m.TargetObject != nil && m.TargetObject.User.Protected) {
-			return true
+		if (m.Source != nil && c.hiddenUser(m.Source)) ||
+			(m.Target != nil && c.hiddenUser(m.Target)) ||
+			(m.TargetObject != nil && (m.TargetObject.User == nil || c.hiddenUser(m.TargetObject.User))) {
+			return "protected_user"
 		}
 		switch m.Event {
 		case "quoted_tweet":
@@ -133,99 +1024,355 @@ func isProtected(message interface{}) bool {
 		case "user_update":
 		case "list_created", "list_destroyed", "list_updated", "list_member_added",
 			"list_member_removed", "list_user_subscribed", "list_user_unsubscribed":
-			return true // lists can be private
+			return "list_event" // lists can be private
 		case "block", "unblock":
-			return true
+			return "block_event"
 		case "mute", "unmute":
-			return true
+			return "mute_event"
 		default:
-			log.WithField("event", m.Event).Warning("Unknown event type")
-			return true // when in doubt...
+			c.log.WithField("event", m.Event).Warning("Unknown event type")
+			c.metrics.unknownEvents.inc(m.Event)
+			return "unknown_event" // when in doubt...
 		}
 	}
-	return false
+	return ""
 }
 
-func (c *Covfefe) HandleChan(messages <-chan *Message) {
-	for m := range messages {
-		c.Handle(m)
+// hiddenUser reports whether user is protected, and not allowed by
+// WithAllowedProtected or WithAllowFollowedProtected.
+func (c *Covfefe) hiddenUser(user *twitter.User) bool {
+	if !user.Protected || c.allowedProtected[user.ID] {
+		return false
 	}
+	return !(c.allowFollowed && user.Following)
 }
 
-func (c *Covfefe) Handle(m *Message) {
-	msg := getMessage(m.msg)
+// limitedAudience reports whether a tweet, or any tweet embedded in it, is
+// only visible to a subset of the author's followers, like Circle and Super
+// Follows tweets. These are not marked by user.protected.
+func limitedAudience(v *fastjson.Value) bool {
+	if v == nil || v.Type() != fastjson.TypeObject {
+		return false
+	}
+	if len(v.GetStringBytes("limited_actions")) != 0 ||
+		v.Exists("trusted_friends_info_result") ||
+		v.Exists("exclusive_tweet_info") ||
+		v.GetBool("super_follows_tweet") {
+		return true
+	}
+	return limitedAudience(v.Get("retweeted_status")) ||
+		limitedAudience(v.Get("quoted_status"))
+}
 
-	if isProtected(msg) {
-		log.WithField("account", m.account.ScreenName).Debug("Dropped protected message")
-		return
+// HandleChan handles messages until the channel is closed or ctx is done,
+// along with the tweets fetched by crawls in the background, so that all
+// messages are handled on the same goroutine. If handled is not nil, it's
+// called after each message with the result of Handle, so the caller can react
+// to failures, for example by cancelling ctx.
+func (c *Covfefe) HandleChan(ctx context.Context, messages <-chan *Message,
+	handled func(m *Message, err error)) {
+	for {
+		var m *Message
+		select {
+		case <-ctx.Done():
+			return
+		case m = <-c.crawledMessages:
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			m = msg
+		}
+		err := c.Handle(m)
+		if handled != nil {
+			handled(m, err)
+		}
+	}
+}
+
+// Handle stores and processes a message. Failures are logged as they happen,
+// and the first one is returned. Messages that are dropped on purpose, like
+// protected tweets, or that are not understood don't cause an error.
+//
+// The message and everything derived from it are written in one transaction.
+// If anything fails, it's rolled back and only the message itself is stored
+// again, so that a rescan or Reprocess can retry it. Work that doesn't need the
+// database, like fetching reply parents, runs after the transaction is done.
+func (c *Covfefe) Handle(m *Message) error {
+	newMessage := m.id == 0
+	err := c.inTransaction(func(conn *sqlite.Conn) error {
+		m.conn = conn
+		defer func() { m.conn = nil }()
+		return c.handle(m)
+	})
+	if err != nil && newMessage && m.id != 0 {
+		c.log.WithError(err).WithField("message", m.id).Warning("Rolled back processing of message")
+		c.forgetMessage(m)
+		if merr := c.store.insertMessage(m); merr != nil {
+			c.log.WithError(merr).Error("Failed to insert message")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	c.markHandled()
+	after := m.after
+	m.after = nil
+	for _, f := range after {
+		err = firstError(err, f())
+	}
+	return err
+}
+
+// HandleRaw handles a raw message received by account, which is decoded with
+// the Decoder set by WithDecoder. See Handle.
+func (c *Covfefe) HandleRaw(msg []byte, account *twitter.User) error {
+	return c.Handle(&Message{account: account, msg: msg})
+}
+
+func (c *Covfefe) handle(m *Message) error {
+	msg := m.decode(c.decoder)
+
+	if reason := c.protectedReason(m, msg); reason != "" {
+		c.metrics.droppedProtected.inc(reason)
+		c.log.WithField("accounts", m.accounts()).WithField("reason", reason).Debug(
+			"Dropped protected message")
+		return nil
+	}
+
+	if c.excludedMessage(msg) {
+		c.log.WithField("accounts", m.accounts()).Debug("Dropped message of excluded user")
+		return nil
+	}
+	if keep, err := c.sampledMessage(m, msg); err != nil {
+		c.log.WithError(err).WithField("accounts", m.accounts()).Error("Failed to look up sampled tweet")
+		return err
+	} else if !keep {
+		return nil
 	}
 
 	switch obj := msg.(type) {
 	case *twitter.Tweet:
-		if err := c.insertMessage(m); err != nil {
-			log.WithError(err).WithField("tweet", obj.ID).Error("Failed to insert message")
-			return
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).WithField("tweet", obj.ID).Error("Failed to insert message")
+			return err
 		}
-		c.processTweet(m, obj)
+		return c.processTweet(m, obj)
 	case *twitter.StatusDeletion:
-		if err := c.insertMessage(m); err != nil {
-			log.WithError(err).WithField("deletion", obj.ID).Error("Failed to insert message")
-			return
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).WithField("deletion", obj.ID).Error("Failed to insert message")
+			return err
 		}
-		log.WithField("id", obj.ID).Debug("Deleted Tweet")
-		c.deletedTweet(obj.ID, m.id)
+		c.log.WithField("id", obj.ID).Debug("Deleted Tweet")
+		c.metrics.deletions.inc()
+		err := c.store.deletedTweet(obj.ID, m)
+		if err != nil {
+			c.log.WithError(err).WithField("tweet", obj.ID).Error("Failed to delete tweet")
+		}
+		if c.purgeMediaOnDeletion && !c.rescan {
+			if perr := c.purgeMedia(m, obj.ID); perr != nil {
+				c.log.WithError(perr).WithField("tweet", obj.ID).Error("Failed to purge media")
+				err = firstError(err, perr)
+			}
+		}
+		for _, account := range m.accounts() {
+			if derr := c.insertDeletion(obj.ID, obj.UserID, account, m); derr != nil {
+				c.log.WithError(derr).WithField("message", m.id).Error("Failed to insert deletion")
+				err = firstError(err, derr)
+			}
+		}
+		return err
+
+	case *twitter.LocationDeletion:
+		// The raw messages are kept, like for deletions, but nothing derived
+		// from them will expose the location.
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).WithField("user", obj.UserID).Error("Failed to insert message")
+			return err
+		}
+		n, err := c.scrubGeo(obj.UserID, obj.UpToStatusID, m)
+		if err != nil {
+			c.log.WithError(err).WithField("user", obj.UserID).Error("Failed to scrub locations")
+			return err
+		}
+		c.log.WithFields(logrus.Fields{
+			"user": obj.UserID, "up_to": obj.UpToStatusID, "tweets": n, "message": m.id,
+		}).Info("Scrubbed locations")
+
+	case *twitter.StreamLimit:
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).Error("Failed to insert message")
+			return err
+		}
+		c.log.WithField("track", obj.Track).Debug("Stream limit")
+		if err := c.insertStreamLimit(obj.Track, m); err != nil {
+			c.log.WithError(err).WithField("message", m.id).Error("Failed to insert stream limit")
+			return err
+		}
+
 	case *twitter.Event:
-		if err := c.insertMessage(m); err != nil {
-			log.WithError(err).WithField("event", obj.Event).Error("Failed to insert message")
-			return
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).WithField("event", obj.Event).Error("Failed to insert message")
+			return err
+		}
+		c.metrics.events.inc()
+		var err error
+		if c.rescan {
+			if cerr := c.setEventCreated(m); cerr != nil {
+				c.log.WithError(cerr).WithField("message", m.id).Error("Failed to set event time")
+				err = cerr
+			}
 		}
 		if obj.Source != nil {
-			c.processUser(m, obj.Source)
+			err = firstError(err, c.processUser(m, obj.Source))
 		}
 		if obj.Target != nil {
-			c.processUser(m, obj.Target)
+			err = firstError(err, c.processUser(m, obj.Target))
 		}
 		if obj.TargetObject != nil {
-			c.processTweet(m, obj.TargetObject)
+			err = firstError(err, c.processTweet(m, obj.TargetObject))
 		}
 		if obj.Event == "follow" {
-			if err := c.insertFollow(obj.Source.ID, obj.Target.ID, m.id); err != nil {
-				log.WithError(err).WithField("message", m.id).Error("Failed to insert follow")
+			if ferr := c.store.insertFollow(obj.Source.ID, obj.Target.ID, m); ferr != nil {
+				c.log.WithError(ferr).WithField("message", m.id).Error("Failed to insert follow")
+				err = firstError(err, ferr)
+			}
+		}
+		if obj.Event == "quoted_tweet" {
+			err = firstError(err, c.processQuoteEvent(m, obj))
+		}
+		// Likes by protected accounts were dropped by isProtected.
+		if (obj.Event == "favorite" || obj.Event == "unfavorite") &&
+			obj.Source != nil && obj.TargetObject != nil {
+			if ferr := c.insertFavorite(obj.Source.ID, obj.TargetObject.ID,
+				obj.Event == "favorite", m); ferr != nil {
+				c.log.WithError(ferr).WithField("message", m.id).Error("Failed to insert favorite")
+				err = firstError(err, ferr)
 			}
 		}
+		return err
+
+	case *twitter.DirectMessage:
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).WithField("dm", obj.ID).Error("Failed to insert message")
+			return err
+		}
+		var err error
+		if obj.Sender != nil {
+			err = firstError(err, c.processUser(m, obj.Sender))
+		}
+		if obj.Recipient != nil {
+			err = firstError(err, c.processUser(m, obj.Recipient))
+		}
+		if derr := c.insertDirectMessage(obj, m); derr != nil {
+			c.log.WithError(derr).WithField("message", m.id).Error("Failed to insert direct message")
+			err = firstError(err, derr)
+		}
+		return err
 
 	case *twitter.StatusWithheld:
-		if err := c.insertMessage(m); err != nil {
-			log.WithError(err).Error("Failed to insert message")
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).Error("Failed to insert message")
+			return err
 		}
-		log.WithFields(log.Fields{
+		scope := withheldScope(m, "status_withheld", "status")
+		c.log.WithFields(logrus.Fields{
 			"id": strconv.FormatInt(obj.ID, 10), "user": strconv.FormatInt(obj.UserID, 10),
-			"countries": strings.Join(obj.WithheldInCountries, ","),
+			"countries": strings.Join(obj.WithheldInCountries, ","), "scope": scope,
 		}).Info("Status withheld")
+		var err error
+		for _, country := range normalizeCountries(obj.WithheldInCountries) {
+			if werr := c.insertStatusWithheld(obj.ID, obj.UserID, country, scope, m); werr != nil {
+				c.log.WithError(werr).WithField("message", m.id).Error("Failed to insert withheld status")
+				err = firstError(err, werr)
+			}
+		}
+		return err
+
 	case *twitter.UserWithheld:
-		if err := c.insertMessage(m); err != nil {
-			log.WithError(err).Error("Failed to insert message")
+		if err := c.store.insertMessage(m); err != nil {
+			c.log.WithError(err).Error("Failed to insert message")
+			return err
 		}
-		log.WithFields(log.Fields{
+		scope := withheldScope(m, "user_withheld", "user")
+		c.log.WithFields(logrus.Fields{
 			"user":      strconv.FormatInt(obj.ID, 10),
-			"countries": strings.Join(obj.WithheldInCountries, ","),
+			"countries": strings.Join(obj.WithheldInCountries, ","), "scope": scope,
 		}).Info("User withheld")
+		var err error
+		for _, country := range normalizeCountries(obj.WithheldInCountries) {
+			if werr := c.insertUserWithheld(obj.ID, country, scope, m); werr != nil {
+				c.log.WithError(werr).WithField("message", m.id).Error("Failed to insert withheld user")
+				err = firstError(err, werr)
+			}
+		}
+		return err
 
 	default:
-		log.Warningf("Unhandled message type: %T", msg)
+		c.log.Warningf("Unhandled message type: %T", msg)
 	}
+	return nil
 }
 
-func (c *Covfefe) httpGet(url string) ([]byte, error) {
-	// TODO: retry
-	res, err := c.httpClient.Get(url)
-	if err != nil {
-		return nil, err
+// withheldScope returns the withheld_scope of a withholding notice, which
+// go-twitter doesn't decode, normalized to lower case, or def if it's absent.
+// key is the field of the notice in the message.
+func withheldScope(m *Message, key, def string) string {
+	v := m.raw()
+	scope := v.GetStringBytes(key, "withheld_scope")
+	if scope == nil {
+		scope = v.GetStringBytes("withheld_scope")
 	}
-	defer res.Body.Close()
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	if len(scope) == 0 {
+		return def
+	}
+	return strings.ToLower(string(scope))
+}
+
+// normalizeCountries returns the distinct, upper-cased country codes of a
+// withholding notice. Besides ISO 3166-1 alpha-2 codes, Twitter uses "XX" for
+// all countries and "XY" for DMCA takedowns.
+func normalizeCountries(countries []string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, cc := range countries {
+		cc = strings.ToUpper(strings.TrimSpace(cc))
+		if cc == "" || seen[cc] {
+			continue
+		}
+		seen[cc] = true
+		res = append(res, cc)
+	}
+	return res
+}
+
+// processAltText stores the accessibility descriptions of the media attached
+// to tweet. go-twitter doesn't decode them, so they are read from the raw JSON.
+func (c *Covfefe) processAltText(m *Message, tweet *twitter.Tweet) (err error) {
+	raw := m.rawTweet(tweet.ID)
+	if raw == nil {
+		return nil
+	}
+	seen := make(map[int64]bool)
+	for _, path := range [][]string{
+		{"extended_tweet", "extended_entities", "media"},
+		{"extended_tweet", "entities", "media"},
+		{"extended_entities", "media"},
+		{"entities", "media"},
+	} {
+		for _, media := range raw.GetArray(path...) {
+			id := media.GetInt64("id")
+			alt := string(media.GetStringBytes("ext_alt_text"))
+			if alt == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if aerr := c.insertAltText(id, tweet.ID, alt, m); aerr != nil {
+				c.log.WithError(aerr).WithField("message", m.id).Error("Failed to insert alt text")
+				err = firstError(err, aerr)
+			}
+		}
 	}
-	return data, nil
+	return err
 }
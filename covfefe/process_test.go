@@ -0,0 +1,882 @@
+package covfefe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+// openTest opens an in-memory archive with opts that doesn't download or crawl
+// anything, and closes it at the end of the test.
+func openTest(t *testing.T, opts ...Option) *Covfefe {
+	t.Helper()
+	c, err := Open(":memory:", append([]Option{WithFetching(false)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// queryIDs returns the first column of the rows of query q, like tweet IDs.
+func queryIDs(t *testing.T, c *Covfefe, q string) []int64 {
+	t.Helper()
+	var ids []int64
+	if err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, q, func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnInt64(0))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestIsProtected(t *testing.T) {
+	const public = `{"id": 1, "screen_name": "public", "protected": false}`
+	const private = `{"id": 2, "screen_name": "private", "protected": true}`
+	tweet := func(user, extra string) string {
+		return fmt.Sprintf(`{"id": 10, "retweet_count": 0, "text": "hi", "user": %s%s}`, user, extra)
+	}
+	event := func(name, source string) string {
+		return fmt.Sprintf(`{"event": %q, "source": %s, "target": %s}`, name, source, public)
+	}
+
+	tests := []struct {
+		name      string
+		msg       string
+		protected bool
+	}{
+		{"public tweet", tweet(public, ""), false},
+		{"protected tweet", tweet(private, ""), true},
+		{"circle tweet", tweet(public, `, "limited_actions": "limit_trusted_friends_tweet"`), true},
+		{"trusted friends tweet", tweet(public, `, "trusted_friends_info_result": {}`), true},
+		{"super follows tweet", tweet(public, `, "super_follows_tweet": true`), true},
+		{"exclusive tweet", tweet(public, `, "exclusive_tweet_info": {}`), true},
+		{"retweet of circle tweet", tweet(public, `, "retweeted_status": `+
+			tweet(public, `, "limited_actions": "limit_trusted_friends_tweet"`)), true},
+		{"quote of public tweet", tweet(public, `, "quoted_status": `+tweet(public, "")), false},
+		{"deletion", `{"delete": {"status": {"id": 10, "user_id": 1}}}`, false},
+		{"direct message", `{"direct_message": {"id": 20, "text": "hi", "sender": ` + public + `}}`, true},
+
+		{"quoted_tweet", event("quoted_tweet", public), false},
+		{"favorite", event("favorite", public), false},
+		{"unfavorite", event("unfavorite", public), false},
+		{"favorited_retweet", event("favorited_retweet", public), false},
+		{"retweeted_retweet", event("retweeted_retweet", public), false},
+		{"follow", event("follow", public), false},
+		{"unfollow", event("unfollow", public), false},
+		{"user_update", event("user_update", public), false},
+		{"list_created", event("list_created", public), true},
+		{"list_destroyed", event("list_destroyed", public), true},
+		{"list_updated", event("list_updated", public), true},
+		{"list_member_added", event("list_member_added", public), true},
+		{"list_member_removed", event("list_member_removed", public), true},
+		{"list_user_subscribed", event("list_user_subscribed", public), true},
+		{"list_user_unsubscribed", event("list_user_unsubscribed", public), true},
+		{"block", event("block", public), true},
+		{"unblock", event("unblock", public), true},
+		{"mute", event("mute", public), true},
+		{"unmute", event("unmute", public), true},
+		{"unknown event", event("something_new", public), true},
+		{"favorite by protected", event("favorite", private), true},
+		{"tweet without user", `{"id": 10, "retweet_count": 0, "text": "hi"}`, true},
+		{"favorite of tweet without user", fmt.Sprintf(`{"event": "favorite", "source": %s, `+
+			`"target": %s, "target_object": {"id": 10, "retweet_count": 0}}`, public, public), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Covfefe{metrics: newMetrics(), log: logrus.StandardLogger()}
+			m := &Message{msg: []byte(tt.msg)}
+			if got := c.isProtected(m, getMessage(m.msg)); got != tt.protected {
+				t.Errorf("isProtected = %v, want %v", got, tt.protected)
+			}
+		})
+	}
+}
+
+func TestHandleTweetWithoutUser(t *testing.T) {
+	c := openTest(t)
+
+	const user = `{"id": 5, "screen_name": "public"}`
+	tweet := func(id int, user, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "created_at": "Mon Jan 02 15:04:05 +0000 2006", `+
+			`"retweet_count": 0, "text": "hi"%s%s}`, id, user, extra)
+	}
+	msgs := []string{
+		tweet(10, "", ""),
+		tweet(11, `, "user": `+user, `, "retweeted_status": `+tweet(12, "", "")),
+		tweet(13, `, "user": `+user, `, "quoted_status_id": 14, "quoted_status": `+tweet(14, "", "")),
+	}
+	for _, msg := range msgs {
+		if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+			t.Errorf("Handle(%s): %v", msg, err)
+		}
+	}
+
+	if ids := queryIDs(t, c, "SELECT id FROM Tweets ORDER BY id;"); fmt.Sprint(ids) != "[11 13]" {
+		t.Errorf("stored tweets %v, want [11 13]", ids)
+	}
+	// The same user is seen in both tweets, and only counted once.
+	if n := c.metrics.users.v; n != 1 {
+		t.Errorf("users counter = %d, want 1", n)
+	}
+}
+
+func TestInspectMedia(t *testing.T) {
+	pad := func(header string) []byte {
+		return append([]byte(header), make([]byte, 64)...)
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		ext         string
+	}{
+		{"png", pad("\x89PNG\r\n\x1a\n"), "image/png", "png"},
+		{"jpeg", pad("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg", "jpg"},
+		{"gif", pad("GIF89a"), "image/gif", "gif"},
+		{"mp4", pad("\x00\x00\x00\x18ftypmp42"), "video/mp4", "mp4"},
+		{"webp", pad("RIFF\x00\x00\x00\x00WEBPVP8 "), "image/webp", "webp"},
+		{"no content type", pad("\x89PNG\r\n\x1a\n"), "", "png"},
+		{"html", pad("<!DOCTYPE html><html>"), "image/png", ""},
+		{"empty", nil, "", ""},
+		{"mismatched content type", pad("\x89PNG\r\n\x1a\n"), "text/html", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mf, err := inspectMedia(bytes.NewReader(tt.data), tt.contentType)
+			if tt.ext == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got extension %q", mf.ext)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mf.ext != tt.ext {
+				t.Errorf("got extension %q, want %q", mf.ext, tt.ext)
+			}
+			if mf.size != int64(len(tt.data)) {
+				t.Errorf("got size %d, want %d", mf.size, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestFullText(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		text string
+	}{
+		{"plain", `{"id": 1, "text": "just setting up my twttr", "truncated": false}`,
+			"just setting up my twttr"},
+		{"truncated", `{"id": 2, "text": "a long tweet that was cut… https://t.co/x", "truncated": true,
+			"extended_tweet": {"full_text": "a long tweet that was cut short by the streaming API"}}`,
+			"a long tweet that was cut short by the streaming API"},
+		{"extended mode", `{"id": 3, "full_text": "fetched with tweet_mode=extended"}`,
+			"fetched with tweet_mode=extended"},
+		{"empty extended tweet", `{"id": 4, "text": "short", "extended_tweet": {"full_text": ""}}`,
+			"short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tweet twitter.Tweet
+			if err := json.Unmarshal([]byte(tt.json), &tweet); err != nil {
+				t.Fatal(err)
+			}
+			if got := fullText(&tweet); got != tt.text {
+				t.Errorf("got %q, want %q", got, tt.text)
+			}
+		})
+	}
+}
+
+func TestParseTwitterTime(t *testing.T) {
+	want := time.Date(2006, time.January, 2, 22, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		s       string
+		want    time.Time
+		wantErr bool
+	}{
+		{"utc", "Mon Jan 02 22:04:05 +0000 2006", want, false},
+		{"negative offset", "Mon Jan 02 15:04:05 -0700 2006", want, false},
+		{"positive offset", "Tue Jan 03 03:34:05 +0530 2006", want, false},
+		{"offset across year", "Sun Jan 01 23:30:00 -0100 2006",
+			time.Date(2006, time.January, 2, 0, 30, 0, 0, time.UTC), false},
+		{"empty", "", time.Time{}, true},
+		{"rfc3339", "2006-01-02T22:04:05Z", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTwitterTime(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got.Location() != time.UTC {
+				t.Errorf("got location %v, want UTC", got.Location())
+			}
+			// The stored form must sort like sqlTime, regardless of the offset.
+			if s := fmt.Sprint(got); s[:19] != sqlTime(tt.want) {
+				t.Errorf("stored as %q, want prefix %q", s, sqlTime(tt.want))
+			}
+		})
+	}
+}
+
+func TestEventCreated(t *testing.T) {
+	c := openTest(t)
+
+	msg := `{"event": "follow", "created_at": "Mon Jan 02 15:04:05 -0700 2006",
+		"source": {"id": 1, "screen_name": "a"}, "target": {"id": 2, "screen_name": "b"}}`
+	if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var created string
+	if err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, "SELECT created FROM Messages;", func(stmt *sqlite.Stmt) error {
+			created = stmt.ColumnText(0)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseSQLTime(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2006, time.January, 2, 22, 4, 5, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("event created %v, want %v", got, want)
+	}
+}
+
+// recordingStore is a store that records what is written to it, before
+// passing it on to the real one.
+type recordingStore struct {
+	store
+	writes []string
+}
+
+func (s *recordingStore) insertMessage(m *Message) error {
+	s.writes = append(s.writes, "message")
+	return s.store.insertMessage(m)
+}
+
+func (s *recordingStore) insertTweet(tweet *twitter.Tweet, conversation int64, compact bool, m *Message) (bool, error) {
+	s.writes = append(s.writes, fmt.Sprintf("tweet %d", tweet.ID))
+	return s.store.insertTweet(tweet, conversation, compact, m)
+}
+
+func (s *recordingStore) insertUser(user *twitter.User, m *Message) (bool, error) {
+	s.writes = append(s.writes, fmt.Sprintf("user %d", user.ID))
+	return s.store.insertUser(user, m)
+}
+
+func (s *recordingStore) insertFollow(follower, target int64, m *Message) error {
+	s.writes = append(s.writes, fmt.Sprintf("follow %d %d", follower, target))
+	return s.store.insertFollow(follower, target, m)
+}
+
+func (s *recordingStore) deletedTweet(tweet int64, m *Message) error {
+	s.writes = append(s.writes, fmt.Sprintf("deleted %d", tweet))
+	return s.store.deletedTweet(tweet, m)
+}
+
+func TestHandleWrites(t *testing.T) {
+	const user = `{"id": 5, "screen_name": "public"}`
+	const other = `{"id": 6, "screen_name": "other"}`
+	tweet := func(id int, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "created_at": "Mon Jan 02 15:04:05 +0000 2006", `+
+			`"retweet_count": 0, "text": "hi", "user": %s%s}`, id, user, extra)
+	}
+	tests := []struct {
+		name   string
+		msg    string
+		writes string
+	}{
+		{"tweet", tweet(10, ""), "[message tweet 10 user 5]"},
+		{"retweet", tweet(11, `, "retweeted_status": `+tweet(12, "")),
+			"[message tweet 11 user 5 tweet 12 user 5]"},
+		{"protected tweet", `{"id": 13, "retweet_count": 0, "text": "hi", ` +
+			`"user": {"id": 7, "screen_name": "private", "protected": true}}`, "[]"},
+		{"follow", `{"event": "follow", "source": ` + user + `, "target": ` + other + `}`,
+			"[message user 5 user 6 follow 5 6]"},
+		{"deletion", `{"delete": {"status": {"id": 10, "user_id": 5}}}`, "[message deleted 10]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := openTest(t)
+			s := &recordingStore{store: c.store}
+			c.store = s
+
+			if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(tt.msg)}); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(s.writes); got != tt.writes {
+				t.Errorf("got writes %s, want %s", got, tt.writes)
+			}
+		})
+	}
+}
+
+func TestHandleRawDecoder(t *testing.T) {
+	// A dump format that wraps tweets in a "data" field.
+	decoder := DecoderFunc(func(msg []byte) interface{} {
+		var wrapped struct{ Data json.RawMessage }
+		if err := json.Unmarshal(msg, &wrapped); err != nil || wrapped.Data == nil {
+			return StreamDecoder.Decode(msg)
+		}
+		tweet := new(twitter.Tweet)
+		if err := json.Unmarshal(wrapped.Data, tweet); err != nil {
+			return nil
+		}
+		return tweet
+	})
+	c := openTest(t, WithDecoder(decoder))
+	s := &recordingStore{store: c.store}
+	c.store = s
+
+	msg := `{"data": {"id": 10, "created_at": "Mon Jan 02 15:04:05 +0000 2006", ` +
+		`"text": "hi", "user": {"id": 5, "screen_name": "public"}}}`
+	if err := c.HandleRaw([]byte(msg), &twitter.User{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(s.writes), "[message tweet 10 user 5]"; got != want {
+		t.Errorf("got writes %s, want %s", got, want)
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	// Payloads as delivered by the Account Activity API, trimmed of the
+	// fields covfefe doesn't read.
+	const tweetCreate = `{
+		"for_user_id": "2244994945",
+		"tweet_create_events": [{
+			"created_at": "Wed Oct 10 20:19:24 +0000 2018",
+			"id": 1050118621198921728,
+			"id_str": "1050118621198921728",
+			"text": "To make room for more expression, we will now count all emojis as equal.",
+			"source": "<a href=\"http://twitter.com\" rel=\"nofollow\">Twitter Web Client</a>",
+			"truncated": false,
+			"in_reply_to_status_id": null,
+			"in_reply_to_user_id": null,
+			"user": {
+				"id": 6253282,
+				"id_str": "6253282",
+				"name": "Twitter API",
+				"screen_name": "TwitterAPI",
+				"description": "The Real Twitter API.",
+				"protected": false,
+				"verified": true,
+				"followers_count": 6133636,
+				"created_at": "Wed May 23 06:01:13 +0000 2007"
+			},
+			"retweet_count": 161,
+			"favorite_count": 296,
+			"entities": {"hashtags": [], "urls": [], "user_mentions": [], "symbols": []},
+			"favorited": false,
+			"retweeted": false,
+			"lang": "en",
+			"timestamp_ms": "1539202764000"
+		}]
+	}`
+	const favorite = `{
+		"for_user_id": "2244994945",
+		"favorite_events": [{
+			"id": "a7ba59eab0bfcba386f7acedac279542",
+			"created_at": "Mon Mar 26 16:33:26 +0000 2018",
+			"timestamp_ms": 1522082006140,
+			"favorited_status": {
+				"created_at": "Mon Mar 26 16:14:57 +0000 2018",
+				"id": 978313736075255808,
+				"id_str": "978313736075255808",
+				"text": "Hello, it's a sunny day.",
+				"truncated": false,
+				"user": {
+					"id": 2244994945,
+					"id_str": "2244994945",
+					"name": "Twitter Dev",
+					"screen_name": "TwitterDev",
+					"description": "Your official source for Twitter Platform news.",
+					"protected": false
+				},
+				"retweet_count": 0,
+				"favorite_count": 1,
+				"entities": {"hashtags": [], "urls": [], "user_mentions": [], "symbols": []},
+				"lang": "en"
+			},
+			"user": {
+				"id": 3198576760,
+				"id_str": "3198576760",
+				"name": "Kanye East",
+				"screen_name": "KanyeEast",
+				"description": "",
+				"protected": false
+			}
+		}]
+	}`
+	const follow = `{
+		"for_user_id": "2244994945",
+		"follow_events": [{
+			"type": "follow",
+			"created_timestamp": "1517588749178",
+			"target": {
+				"id": "2244994945",
+				"created_timestamp": "1384811450000",
+				"name": "Twitter Dev",
+				"screen_name": "TwitterDev",
+				"description": "Your official source for Twitter Platform news.",
+				"protected": false,
+				"verified": true,
+				"followers_count": 503828,
+				"friends_count": 1477,
+				"statuses_count": 3450,
+				"profile_background_image_url": "null",
+				"default_profile": false,
+				"default_profile_image": false
+			},
+			"source": {
+				"id": "3198576760",
+				"created_timestamp": "1428004725000",
+				"name": "Kanye East",
+				"screen_name": "KanyeEast",
+				"description": "",
+				"protected": false,
+				"verified": false,
+				"followers_count": 12,
+				"friends_count": 22,
+				"statuses_count": 4,
+				"profile_background_image_url": "null",
+				"default_profile": true,
+				"default_profile_image": false
+			}
+		}]
+	}`
+	const tweetDelete = `{
+		"for_user_id": "6253282",
+		"tweet_delete_events": [{
+			"status": {"id": "1050118621198921728", "user_id": "6253282"},
+			"timestamp_ms": "1539202800000"
+		}]
+	}`
+
+	c := openTest(t)
+	account := &twitter.User{ID: 2244994945}
+	for _, payload := range []string{tweetCreate, favorite, follow, tweetDelete} {
+		if err := c.HandleWebhook([]byte(payload), account); err != nil {
+			t.Fatalf("HandleWebhook(%s): %v", payload, err)
+		}
+	}
+
+	query := func(q string) string {
+		var rows []string
+		if err := c.withConn(func(conn *sqlite.Conn) error {
+			return sqliteutil.Exec(conn, q, func(stmt *sqlite.Stmt) error {
+				var cols []string
+				for i := 0; i < stmt.ColumnCount(); i++ {
+					cols = append(cols, stmt.ColumnText(i))
+				}
+				rows = append(rows, strings.Join(cols, " "))
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(rows, ",")
+	}
+	tests := []struct{ query, want string }{
+		{"SELECT id, user, deleted IS NOT NULL FROM Tweets ORDER BY id;",
+			"978313736075255808 2244994945 0,1050118621198921728 6253282 1"},
+		{"SELECT user, tweet, added FROM Favorites;", "3198576760 978313736075255808 1"},
+		{"SELECT follower, target FROM Follows;", "3198576760 2244994945"},
+		{"SELECT tweet, user, account FROM Deletions;", "1050118621198921728 6253282 2244994945"},
+	}
+	for _, tt := range tests {
+		if got := query(tt.query); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestEntityText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		indices twitter.Indices
+		unit    offsetUnit
+		want    string
+	}{
+		{"ascii", "see https://t.co/x now", twitter.Indices{4, 18}, codePoints, "https://t.co/x"},
+		{"emoji code points", "🐈🐈 https://t.co/x", twitter.Indices{3, 17}, codePoints, "https://t.co/x"},
+		{"emoji utf-16", "🐈🐈 https://t.co/x", twitter.Indices{5, 19}, utf16Units, "https://t.co/x"},
+		{"cjk", "猫が好き #ねこ です", twitter.Indices{5, 8}, codePoints, "#ねこ"},
+		{"cjk utf-16", "猫が好き #ねこ です", twitter.Indices{5, 8}, utf16Units, "#ねこ"},
+		{"flag", "🇮🇹 #pizza", twitter.Indices{3, 9}, codePoints, "#pizza"},
+		{"past the end", "short", twitter.Indices{2, 50}, codePoints, "ort"},
+		{"reversed", "short", twitter.Indices{3, 1}, codePoints, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entityText(tt.text, tt.indices, tt.unit); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	const s = "a🐈猫b"
+	for _, tt := range []struct {
+		byteIndex, codePoint, utf16 int
+	}{
+		{0, 0, 0}, {1, 1, 1}, {5, 2, 3}, {8, 3, 4}, {9, 4, 5},
+	} {
+		if got := byteOffset(s, tt.codePoint, codePoints); got != tt.byteIndex {
+			t.Errorf("byteOffset(%d, codePoints) = %d, want %d", tt.codePoint, got, tt.byteIndex)
+		}
+		if got := byteOffset(s, tt.utf16, utf16Units); got != tt.byteIndex {
+			t.Errorf("byteOffset(%d, utf16Units) = %d, want %d", tt.utf16, got, tt.byteIndex)
+		}
+		if got := unitOffset(s, tt.byteIndex, utf16Units); got != tt.utf16 {
+			t.Errorf("unitOffset(%d, utf16Units) = %d, want %d", tt.byteIndex, got, tt.utf16)
+		}
+		if got := runeOffset(s, tt.byteIndex); got != tt.codePoint {
+			t.Errorf("runeOffset(%d) = %d, want %d", tt.byteIndex, got, tt.codePoint)
+		}
+	}
+	// An offset between the halves of a surrogate pair rounds up.
+	if got := byteOffset(s, 2, utf16Units); got != 5 {
+		t.Errorf("byteOffset(2, utf16Units) = %d, want 5", got)
+	}
+}
+
+func TestDisplayTextRange(t *testing.T) {
+	const text = "@alice🐈 hi https://t.co/x"
+	tests := []struct {
+		name    string
+		tweet   *twitter.Tweet
+		display string
+		ok      bool
+	}{
+		{"reply", &twitter.Tweet{DisplayTextRange: twitter.Indices{8, 10}}, "hi", true},
+		{"missing", &twitter.Tweet{}, "", false},
+		{"out of order", &twitter.Tweet{DisplayTextRange: twitter.Indices{10, 8}}, "", false},
+		{"past the end", &twitter.Tweet{DisplayTextRange: twitter.Indices{8, 100}}, "hi https://t.co/x", true},
+		{"extended", &twitter.Tweet{DisplayTextRange: twitter.Indices{0, 5}, ExtendedTweet: &twitter.ExtendedTweet{
+			FullText: text, DisplayTextRange: twitter.Indices{0, 7}}}, "@alice🐈", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := displayTextRange(tt.tweet, text)
+			if ok != tt.ok {
+				t.Fatalf("displayTextRange ok = %v, want %v", ok, tt.ok)
+			}
+			if got := entityText(text, r, codePoints); ok && got != tt.display {
+				t.Errorf("display text %q, want %q", got, tt.display)
+			}
+		})
+	}
+}
+
+func TestExcludedUsers(t *testing.T) {
+	c := openTest(t, WithExcludedUsers(6))
+
+	tweet := func(id, user int, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "retweet_count": 0, `+
+			`"text": "hi", "user": {"id": %d, "screen_name": "u%d"}%s}`, id, user, user, extra)
+	}
+	for _, msg := range []string{
+		tweet(10, 6, ""),
+		tweet(11, 5, `, "retweeted_status": `+tweet(12, 6, `, "quoted_status": `+tweet(13, 7, ""))),
+	} {
+		if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(q string) string { return fmt.Sprint(queryIDs(t, c, q)) }
+	if got := query("SELECT id FROM Tweets ORDER BY id;"); got != "[11]" {
+		t.Errorf("stored tweets %v, want [11]", got)
+	}
+	if got := query("SELECT id FROM Users ORDER BY id;"); got != "[5]" {
+		t.Errorf("stored users %v, want [5]", got)
+	}
+	if got := query("SELECT COUNT(*) FROM Messages;"); got != "[1]" {
+		t.Errorf("stored %v messages, want [1]", got)
+	}
+}
+
+func TestDedupTweets(t *testing.T) {
+	c := openTest(t, WithDedupTweets(true))
+
+	tweet := func(favorited bool, count int) string {
+		return fmt.Sprintf(`{"id": 10, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "text": "hi", `+
+			`"favorited": %v, "retweet_count": %d, "user": {"id": 5, "screen_name": "u", "following": %v}}`,
+			favorited, count, favorited)
+	}
+	for i, msg := range []string{tweet(false, 0), tweet(true, 0), tweet(false, 3)} {
+		account := &twitter.User{ID: int64(i + 1)}
+		if err := c.Handle(&Message{account: account, msg: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var accounts []string
+	if err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, "SELECT account FROM Messages ORDER BY id;", func(stmt *sqlite.Stmt) error {
+			accounts = append(accounts, stmt.ColumnText(0))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(accounts); got != "[[1,2] [3]]" {
+		t.Errorf("stored messages with accounts %s, want [[1,2] [3]]", got)
+	}
+}
+
+func TestCompactAfterFull(t *testing.T) {
+	c := openTest(t, WithConflictStrategy(UpdateConflicts))
+
+	full := `{"id": 10, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "retweet_count": 0, ` +
+		`"full_text": "the whole tweet text", "display_text_range": [0, 20], "entities": {}, ` +
+		`"user": {"id": 5, "screen_name": "u"}}`
+	compact := `{"id": 10, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "retweet_count": 2, ` +
+		`"text": "the whole…", "truncated": true, "user": {"id": 5, "screen_name": "u"}}`
+	for _, msg := range []string{full, compact} {
+		if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	if err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT t.text, t.display_end, t.compact, t.retweets, x.text
+			FROM Tweets t JOIN TweetsText x ON x.rowid = t.id;`, func(stmt *sqlite.Stmt) error {
+			for i := 0; i < stmt.ColumnCount(); i++ {
+				got = append(got, stmt.ColumnText(i))
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "the whole tweet text,20,0,2,the whole tweet text"; strings.Join(got, ",") != want {
+		t.Errorf("stored %q, want %q", strings.Join(got, ","), want)
+	}
+}
+
+func TestMaxNesting(t *testing.T) {
+	c := openTest(t, WithMaxNesting(3))
+
+	// A chain of retweets of quotes of retweets, ten deep.
+	msg := ""
+	for id := 10; id > 0; id-- {
+		field := "retweeted_status"
+		if id%2 == 0 {
+			field = "quoted_status"
+		}
+		nested := ""
+		if msg != "" {
+			nested = fmt.Sprintf(`, %q: %s`, field, msg)
+		}
+		msg = fmt.Sprintf(`{"id": %d, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "retweet_count": 0, `+
+			`"text": "hi", "user": {"id": 5, "screen_name": "u"}%s}`, id, nested)
+	}
+	if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryIDs(t, c, "SELECT id FROM Tweets ORDER BY id;"); fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("stored tweets %v, want [1 2 3]", ids)
+	}
+
+	// In dry run mode nothing is stored, so a cyclic tweet, which a custom
+	// Decoder could produce, would otherwise be processed forever.
+	cyclic := &twitter.Tweet{ID: 20, CreatedAt: "Mon Jan 02 15:04:05 +0000 2006", User: &twitter.User{ID: 5}}
+	cyclic.QuotedStatus = cyclic
+	d := openTest(t, WithDryRun(true), WithDecoder(DecoderFunc(func([]byte) interface{} {
+		return cyclic
+	})))
+	if err := d.HandleRaw([]byte(`{}`), &twitter.User{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMediaProcessors(t *testing.T) {
+	dir := t.TempDir()
+	var calls []string
+	processor := func(name string, suffix []byte) MediaProcessor {
+		return MediaProcessorFunc(func(id int64, data []byte, mediaType string) ([]byte, error) {
+			calls = append(calls, fmt.Sprintf("%s %d %s", name, id, mediaType))
+			return append(data, suffix...), nil
+		})
+	}
+	c := openTest(t, WithMediaStore(&FileStore{Dir: dir}),
+		WithMediaProcessors(processor("a", []byte("A")), processor("b", []byte("B"))))
+
+	data := append([]byte("GIF89a"), make([]byte, 64)...)
+	if err := c.saveMedia(bytes.NewReader(data), "image/gif", 100, 10, "https://example.com/a.gif"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(calls); got != "[a 100 image/gif b 100 image/gif]" {
+		t.Errorf("processors called as %v", got)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "100.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(data, "AB"...); !bytes.Equal(stored, want) {
+		t.Errorf("stored %q, want %q", stored, want)
+	}
+
+	failing := MediaProcessorFunc(func(int64, []byte, string) ([]byte, error) {
+		return nil, errors.New("no thanks")
+	})
+	c.mediaProcessors = []MediaProcessor{failing}
+	if err := c.saveMedia(bytes.NewReader(data), "image/gif", 101, 10, "https://example.com/b.gif"); err == nil {
+		t.Error("saveMedia succeeded with a failing processor")
+	}
+}
+
+func TestSampled(t *testing.T) {
+	var kept, subset int
+	for id := int64(1212092628029698048); id < 1212092628029698048+10000; id++ {
+		if sampled(id, 0.1) {
+			kept++
+		}
+		if sampled(id, 0.05) && !sampled(id, 0.1) {
+			subset++
+		}
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("sampled %d of 10000 IDs at rate 0.1", kept)
+	}
+	if subset != 0 {
+		t.Errorf("%d IDs sampled at rate 0.05 but not at 0.1", subset)
+	}
+}
+
+func TestSampledDeletions(t *testing.T) {
+	// At rate 0.5, tweet 11 is sampled, and 13 and 16 are not.
+	c := openTest(t, WithSampleRate(0.5))
+	tweet := func(id int, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "created_at": "Mon Jan 02 15:04:05 +0000 2006", "retweet_count": 0, `+
+			`"text": "hi", "user": {"id": 5, "screen_name": "u"}%s}`, id, extra)
+	}
+	favorite := func(id int) string {
+		return `{"event": "favorite", "created_at": "Mon Jan 02 15:04:05 +0000 2006", ` +
+			`"source": {"id": 7, "screen_name": "fan"}, "target": {"id": 5, "screen_name": "u"}, ` +
+			`"target_object": ` + tweet(id, "") + `}`
+	}
+	for _, msg := range []string{
+		tweet(11, `, "retweeted_status": `+tweet(13, "")),
+		tweet(16, ""),
+		favorite(13),
+		favorite(16),
+		`{"delete": {"status": {"id": 13, "user_id": 5}}}`,
+	} {
+		if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(queryIDs(t, c, "SELECT id FROM Tweets ORDER BY id;")); got != "[11 13]" {
+		t.Errorf("stored tweets %v, want [11 13]", got)
+	}
+	if got := fmt.Sprint(queryIDs(t, c, "SELECT id FROM Tweets WHERE deleted IS NOT NULL;")); got != "[13]" {
+		t.Errorf("deleted tweets %v, want [13]", got)
+	}
+	if got := fmt.Sprint(queryIDs(t, c, "SELECT tweet FROM Favorites;")); got != "[13]" {
+		t.Errorf("stored favorites of %v, want [13]", got)
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	var published []string
+	publisher := PublisherFunc(func(ctx context.Context, topic string, payload []byte) error {
+		published = append(published, topic+" "+string(payload))
+		return nil
+	})
+	// Not openTest, as the test checks what Close publishes.
+	c, err := Open(":memory:", WithFetching(false), WithPublisher(publisher, "tweets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := `{"id":10,"created_at":"Mon Jan 02 15:04:05 +0000 2006","retweet_count":0,"text":"hi","user":{"id":5,"screen_name":"u"}}`
+	for i := 0; i < 2; i++ {
+		if err := c.Handle(&Message{account: &twitter.User{ID: 1}, msg: []byte(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Tweets are not published again by a rescan.
+	if err := c.Rescan(1); err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the queue to drain.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := `tweets {"id":10,"created_at":"Mon Jan 02 15:04:05 +0000 2006","retweet_count":0,"text":"hi","user":{"id":5,"screen_name":"u"}}`
+	if len(published) != 1 || published[0] != want {
+		t.Errorf("published %q, want %q", published, want)
+	}
+	if n := c.metrics.published.v; n != 1 {
+		t.Errorf("published counter = %d, want 1", n)
+	}
+}
+
+func TestAllowedProtected(t *testing.T) {
+	tweets := []string{
+		`{"id": 10, "retweet_count": 0, "user": {"id": 5, "protected": true}}`,
+		`{"id": 11, "retweet_count": 0, "user": {"id": 6, "protected": true, "following": true}}`,
+		`{"id": 12, "retweet_count": 0, "user": {"id": 7, "protected": true}, "limited_actions": "non_compliant"}`,
+	}
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "protected_user,protected_user,protected_user"},
+		{[]Option{WithAllowedProtected(5, 7)}, ",protected_user,limited_audience"},
+		{[]Option{WithAllowFollowedProtected(true)}, "protected_user,,protected_user"},
+	} {
+		c := openTest(t, tc.opts...)
+		var reasons []string
+		for _, raw := range tweets {
+			m := &Message{msg: []byte(raw)}
+			var tweet twitter.Tweet
+			if err := json.Unmarshal(m.msg, &tweet); err != nil {
+				t.Fatal(err)
+			}
+			reasons = append(reasons, c.protectedReason(m, &tweet))
+		}
+		if got := strings.Join(reasons, ","); got != tc.want {
+			t.Errorf("with %d options, reasons are %q, want %q", len(tc.opts), got, tc.want)
+		}
+	}
+}
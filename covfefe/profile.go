@@ -0,0 +1,97 @@
+package covfefe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+// profileName is the name under which a profile image or banner is stored.
+// Images are keyed by hash, to keep the history of each user's changes.
+func profileName(user int64, kind, hash, ext string) string {
+	return fmt.Sprintf("%s-%d-%s.%s", kind, user, hash[:16], ext)
+}
+
+// processProfileImages downloads the avatar and banner of user in the
+// background, unless they were already archived.
+func (c *Covfefe) processProfileImages(m *Message, user *twitter.User) {
+	if !c.fetching() {
+		return
+	}
+	var images [][2]string // kind, URL
+	if u := user.ProfileImageURLHttps; u != "" && !user.DefaultProfileImage &&
+		!strings.Contains(u, "/default_profile_images/") {
+		// The API returns the 48x48 version, the larger one has a suffix.
+		images = append(images, [2]string{"avatar", strings.Replace(u, "_normal.", "_400x400.", 1)})
+	}
+	if u := user.ProfileBannerURL; u != "" {
+		images = append(images, [2]string{"banner", u + "/1500x500"})
+	}
+	if len(images) == 0 {
+		return
+	}
+	c.inBackground(m, func() {
+		for _, img := range images {
+			c.downloadProfileImage(user.ID, img[0], img[1], m.id)
+		}
+	})
+}
+
+func (c *Covfefe) downloadProfileImage(user int64, kind, url string, message int64) {
+	log := c.log.WithFields(logrus.Fields{
+		"url": url, "user": user, "kind": kind,
+	})
+	if _, loaded := c.downloads.LoadOrStore(url, user); loaded {
+		return
+	}
+	defer c.downloads.Delete(url)
+	if ok, err := c.profileImageExists(url); err != nil {
+		log.WithError(err).Error("Failed to look up profile image")
+		return
+	} else if ok {
+		return
+	}
+
+	select {
+	case c.mediaSem <- struct{}{}:
+		defer func() { <-c.mediaSem }()
+	case <-c.ctx.Done():
+		log.Warning("Abandoned profile image download")
+		return
+	}
+	f, contentType, err := c.download(c.ctx, url)
+	if err != nil {
+		log.WithError(err).Error("Failed to download profile image")
+		c.metrics.mediaFailed.inc()
+		return
+	}
+	defer removeTemp(f)
+	mf, err := inspectMedia(f, contentType)
+	if err != nil {
+		log.WithError(err).Error("Failed to save profile image")
+		c.metrics.mediaFailed.inc()
+		return
+	}
+	if c.dryRun {
+		log.WithField("hash", mf.hash).WithField("type", mf.mime).
+			WithField("size", mf.size).Info("Dry run: would save profile image")
+		return
+	}
+	name := profileName(user, kind, mf.hash, mf.ext)
+	if ok, err := c.profileImageStored(name); err != nil {
+		log.WithError(err).Error("Failed to look up profile image")
+		return
+	} else if !ok {
+		if err := c.media.Put(name, f); err != nil {
+			log.WithError(err).Error("Failed to save profile image")
+			c.metrics.mediaFailed.inc()
+			return
+		}
+		c.metrics.mediaDownloaded.inc()
+	}
+	if err := c.insertProfileImage(user, kind, url, mf.hash, name, message); err != nil {
+		log.WithError(err).Error("Failed to insert profile image")
+	}
+}
@@ -0,0 +1,90 @@
+package covfefe
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A Publisher emits newly archived tweets to a message queue, like a Kafka or
+// NATS topic, for downstream consumers. See WithPublisher.
+type Publisher interface {
+	// Publish sends payload to topic. It should return once the message is
+	// accepted, and give up when ctx is done.
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface.
+type PublisherFunc func(ctx context.Context, topic string, payload []byte) error
+
+// Publish calls f(ctx, topic, payload).
+func (f PublisherFunc) Publish(ctx context.Context, topic string, payload []byte) error {
+	return f(ctx, topic, payload)
+}
+
+// NopPublisher is a Publisher that discards every message.
+var NopPublisher Publisher = PublisherFunc(func(context.Context, string, []byte) error { return nil })
+
+const (
+	// publishQueueSize is how many tweets can wait to be published before
+	// new ones are dropped, so that a slow consumer doesn't hold up archiving.
+	publishQueueSize = 1024
+
+	// publishDrainTimeout is how long Close waits for the queued tweets to
+	// be published, before cancelling the pending Publish calls.
+	publishDrainTimeout = 10 * time.Second
+)
+
+type publication struct {
+	tweet   int64
+	payload []byte
+}
+
+// startPublisher starts the goroutine that publishes the tweets queued by
+// publish, until stopPublisher is called.
+func (c *Covfefe) startPublisher() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.publishQueue = make(chan publication, publishQueueSize)
+	c.publishCancel = cancel
+	c.publishDone = make(chan struct{})
+	go func() {
+		defer close(c.publishDone)
+		for p := range c.publishQueue {
+			err := c.publisher.Publish(ctx, c.publishTopic, p.payload)
+			if err != nil {
+				c.metrics.publishFailed.inc()
+				c.log.WithError(err).WithFields(logrus.Fields{
+					"tweet": p.tweet, "topic": c.publishTopic,
+				}).Warning("Failed to publish tweet")
+				continue
+			}
+			c.metrics.published.inc()
+		}
+	}()
+}
+
+// publish queues the JSON of a new tweet to be published, without blocking.
+// If the queue is full the tweet is dropped, and only logged and counted.
+func (c *Covfefe) publish(tweet int64, payload []byte) {
+	select {
+	case c.publishQueue <- publication{tweet, payload}:
+	default:
+		c.metrics.publishDropped.inc()
+		c.log.WithField("tweet", tweet).Warning("Publish queue full, dropped tweet")
+	}
+}
+
+// stopPublisher waits for the queued tweets to be published, for up to
+// publishDrainTimeout, and then stops the publishing goroutine.
+func (c *Covfefe) stopPublisher() {
+	close(c.publishQueue)
+	select {
+	case <-c.publishDone:
+	case <-time.After(publishDrainTimeout):
+		c.log.WithField("queued", len(c.publishQueue)).Warning("Timed out publishing tweets")
+		c.publishCancel()
+		<-c.publishDone
+	}
+	c.publishCancel()
+}
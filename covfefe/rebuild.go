@@ -0,0 +1,160 @@
+package covfefe
+
+import (
+	"sort"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+)
+
+// rebuildBatch is how many tweets RebuildIndexes processes in each transaction.
+const rebuildBatch = 1000
+
+// extractors are the processing steps that RebuildIndexes can run, by the
+// table they populate.
+var extractors = map[string]func(c *Covfefe, m *Message, tweet *twitter.Tweet) error{
+	"AltTexts":    (*Covfefe).processAltText,
+	"EditHistory": (*Covfefe).processEditHistory,
+	"Hashtags":    (*Covfefe).processHashtags,
+	"Mentions":    (*Covfefe).processMentions,
+	"Places":      (*Covfefe).processPlace, // and Locations
+	"Polls":       (*Covfefe).processPoll,
+	"Quotes":      (*Covfefe).processQuote,
+	"Symbols":     (*Covfefe).processSymbols,
+	"TweetJSON":   (*Covfefe).processTweetJSON,
+	"URLs":        (*Covfefe).processURLs,
+	"MediaInfo": func(c *Covfefe, m *Message, tweet *twitter.Tweet) error {
+		return c.processMediaInfo(m, tweet.ID, tweetMedia(tweet))
+	},
+}
+
+// RebuildIndexes populates the given derived tables by running their
+// extraction step again on every archived tweet, from the message it was stored
+// from. It's useful to fill in tables added after the tweets were archived,
+// without a full Rescan.
+//
+// The supported tables are AltTexts, EditHistory, Hashtags, MediaInfo,
+// Mentions, Places (which also populates Locations), Polls, Quotes, Symbols,
+// TweetJSON and URLs.
+// If none are given, all of them are rebuilt, except TweetJSON unless
+// WithStoreTweetJSON is enabled. Existing rows are kept, so it's safe to run
+// repeatedly. Like during a rescan, nothing is downloaded or crawled, and
+// RebuildIndexes must not be called while Run is running.
+func (c *Covfefe) RebuildIndexes(tables ...string) error {
+	if len(tables) == 0 {
+		for table := range extractors {
+			if table != "TweetJSON" || c.storeTweetJSON {
+				tables = append(tables, table)
+			}
+		}
+		sort.Strings(tables)
+	}
+	var steps []func(c *Covfefe, m *Message, tweet *twitter.Tweet) error
+	for _, table := range tables {
+		f, ok := extractors[table]
+		if !ok {
+			var valid []string
+			for table := range extractors {
+				valid = append(valid, table)
+			}
+			sort.Strings(valid)
+			return errors.Errorf("can't rebuild table %q, supported tables are %s",
+				table, strings.Join(valid, ", "))
+		}
+		steps = append(steps, f)
+	}
+
+	rescan := c.rescan
+	c.rescan = true
+	defer func() { c.rescan = rescan }()
+
+	c.log.WithField("tables", tables).Info("Rebuilding indexes...")
+	var last int64
+	var total int
+	for {
+		n, err := c.rebuildBatch(&last, steps)
+		if err != nil {
+			return err
+		}
+		total += n
+		c.log.WithField("tweets", total).Info("Rebuild progress")
+		if n < rebuildBatch {
+			return nil
+		}
+	}
+}
+
+// rebuildBatch runs steps on up to rebuildBatch tweets with an ID after *last,
+// in a single transaction, and advances *last past them.
+func (c *Covfefe) rebuildBatch(last *int64, steps []func(c *Covfefe, m *Message, tweet *twitter.Tweet) error) (int, error) {
+	type storedTweet struct {
+		id int64
+		m  *Message
+	}
+	var batch []storedTweet
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT Tweets.id AS tweet, Messages.id AS id, Messages.json AS json,
+			Messages.account AS account, Messages.compressed AS compressed
+			FROM Tweets JOIN Messages ON Tweets.message = Messages.id
+			WHERE Tweets.id > ? ORDER BY Tweets.id LIMIT ?;`,
+			func(stmt *sqlite.Stmt) error {
+				m, err := storedMessage(stmt)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, storedTweet{stmt.GetInt64("tweet"), m})
+				return nil
+			}, *last, rebuildBatch)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "listing Tweets failed")
+	}
+
+	err = c.inTransaction(func(conn *sqlite.Conn) (err error) {
+		for _, t := range batch {
+			t.m.conn = conn
+			tweet := findDecodedTweet(t.m.decode(c.decoder), t.id)
+			if tweet == nil {
+				c.log.WithField("tweet", t.id).WithField("message", t.m.id).Warning(
+					"Tweet not found in its message")
+				continue
+			}
+			for _, step := range steps {
+				err = firstError(err, step(c, t.m, tweet))
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) > 0 {
+		*last = batch[len(batch)-1].id
+	}
+	return len(batch), nil
+}
+
+// findDecodedTweet returns the tweet with the given ID in a decoded message,
+// looking into retweeted, quoted and event target tweets, like findTweet.
+func findDecodedTweet(msg interface{}, id int64) *twitter.Tweet {
+	var tweet *twitter.Tweet
+	switch m := msg.(type) {
+	case *twitter.Tweet:
+		tweet = m
+	case *twitter.Event:
+		tweet = m.TargetObject
+	}
+	if tweet == nil {
+		return nil
+	}
+	if tweet.ID == id {
+		return tweet
+	}
+	if t := findDecodedTweet(tweet.RetweetedStatus, id); t != nil {
+		return t
+	}
+	return findDecodedTweet(tweet.QuotedStatus, id)
+}
@@ -3,73 +3,309 @@ package covfefe
 import (
 	"fmt"
 	"os"
+	"strconv"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
 	"github.com/pkg/errors"
 	"github.com/schollz/progressbar/v2"
-	log "github.com/sirupsen/logrus"
-	"github.com/v2pro/plz/gls"
+	"github.com/valyala/fastjson"
 )
 
-func Rescan(dbPath string) (err error) {
-	// We use a single connection for performance and rollback.
-	conn, err := sqlite.OpenConn("file:"+dbPath, 0)
+// rescanBatch is how many messages are processed in each transaction. The
+// progress of a rescan is saved at the end of each batch.
+const rescanBatch = 10000
+
+// Rescan opens the database at dbPath and regenerates all tables derived from
+// Messages, see (*Covfefe).Rescan. If restart is true, an interrupted rescan
+// is started over instead of resumed.
+func Rescan(dbPath string, restart bool, concurrency int) error {
+	c, err := Open(dbPath)
 	if err != nil {
-		return errors.Wrap(err, "failed to open database")
+		return err
 	}
-	defer conn.Close()
-	defer sqliteutil.Save(conn)(&err)
+	defer c.Close()
 
-	mainID := gls.GoID()
-	c := &Covfefe{
-		withConn: func(f func(conn *sqlite.Conn) error) error {
-			if gls.GoID() != mainID {
-				// This goroutine owns the conn, as it has an open
-				// statement until the end. Also, no locking!
-				panic("rescan should not use multiple goroutines")
-			}
-			return f(conn)
-		},
-		rescan: true,
+	if restart {
+		if err := c.execSQL(nil, "DELETE FROM RescanState;"); err != nil {
+			return errors.Wrap(err, "failed to clear rescan state")
+		}
 	}
+	return c.Rescan(concurrency)
+}
 
-	if err := c.initDB(); err != nil {
-		return err
+// Rescan regenerates all tables derived from Messages. Messages are decoded by
+// concurrency goroutines, and then processed in order.
+//
+// Progress is saved in RescanState after each batch, and an interrupted rescan
+// resumes from there. Until a rescan completes, the derived tables only reflect
+// part of the archive. Rescan must not be called while Run is running.
+func (c *Covfefe) Rescan(concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
 	}
 
-	log.Info("Dropping tables...")
+	// We use a single connection for performance and rollback.
+	return c.withConn(func(conn *sqlite.Conn) error {
+		// Need to have foreign keys OFF for TRUNCATE.
+		if err := sqliteutil.Exec(conn, "PRAGMA foreign_keys = OFF;", nil); err != nil {
+			return errors.Wrap(err, "failed to disable foreign keys")
+		}
+
+		withConn, rescan := c.withConn, c.rescan
+		defer func() { c.withConn, c.rescan = withConn, rescan }()
+		// This goroutine owns the conn, and there is no locking. Only
+		// decoding happens concurrently, see rescanBatch.
+		c.withConn = func(f func(conn *sqlite.Conn) error) error {
+			return f(conn)
+		}
+		c.rescan = true
+
+		var last int64 = -1
+		if err := sqliteutil.Exec(conn, "SELECT last_message FROM RescanState;",
+			func(stmt *sqlite.Stmt) error {
+				last = stmt.ColumnInt64(0)
+				return nil
+			}); err != nil {
+			return errors.Wrap(err, "failed to load rescan state")
+		}
+		if last < 0 {
+			if err := c.truncateDerived(conn); err != nil {
+				return err
+			}
+			last = 0
+			c.log.Info("Starting rescan...")
+		} else {
+			c.log.WithField("message", last).Info("Resuming rescan...")
+		}
+
+		count, err := sqliteutil.ResultInt64(conn.Prep("SELECT COUNT(*) FROM Messages;"))
+		if err != nil {
+			return errors.Wrap(err, "failed to count messages")
+		}
+		pb := progressbar.NewOptions64(count, progressbar.OptionShowCount())
+		stmt := conn.Prep("SELECT COUNT(*) FROM Messages WHERE id <= $last;")
+		stmt.SetInt64("$last", last)
+		skipped, err := sqliteutil.ResultInt64(stmt)
+		if err != nil {
+			return errors.Wrap(err, "failed to count messages")
+		}
+		pb.Add64(skipped)
 
-	// Need to have foreign keys OFF for TRUNCATE
+		for {
+			n, err := c.rescanBatch(conn, &last, concurrency, pb)
+			if err != nil {
+				return err
+			}
+			if n < rescanBatch {
+				break
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "\n")
+		c.log.Info("Finishing up...")
+
+		if err := sqliteutil.Exec(conn, "DELETE FROM RescanState;", nil); err != nil {
+			return errors.Wrap(err, "failed to clear rescan state")
+		}
+		return nil
+	})
+}
+
+// truncateDerived empties all tables generated from Messages, and records the
+// start of a new rescan.
+func (c *Covfefe) truncateDerived(conn *sqlite.Conn) error {
+	c.log.Info("Dropping tables...")
+
+	// Media, MediaErrors, PendingMedia, ProfileImages, CardImages and
+	// ResolvedURLs are not dropped, as rescans don't download anything.
 	if err := sqliteutil.ExecScript(conn, `
 		DELETE FROM Tweets;
 		DELETE FROM Users;
 		DELETE FROM Follows;
+		DELETE FROM Favorites;
+		DELETE FROM Quotes;
+		DELETE FROM Retweets;
+		DELETE FROM URLs;
+		DELETE FROM Hashtags;
+		DELETE FROM Symbols;
+		DELETE FROM Mentions;
+		DELETE FROM DirectMessages;
+		DELETE FROM StatusWithheld;
+		DELETE FROM UserWithheld;
+		DELETE FROM StreamLimits;
+		DELETE FROM Deletions;
+		DELETE FROM Engagement;
+		DELETE FROM TweetAccounts;
+		DELETE FROM UserAccounts;
+		DELETE FROM PinnedTweets;
+		DELETE FROM EditHistory;
+		DELETE FROM Polls;
+		DELETE FROM Locations;
+		DELETE FROM Places;
+		DELETE FROM AltTexts;
+		DELETE FROM MediaInfo;
+		DELETE FROM TweetsText;
+		DELETE FROM TweetJSON;
+		DELETE FROM RescanState;
+		INSERT INTO RescanState (last_message) VALUES (0);
 	`); err != nil {
 		return errors.Wrap(err, "failed to truncate tables")
 	}
+	if c.tweetIDs != nil {
+		c.tweetIDs.Clear()
+	}
+	return nil
+}
 
-	log.Info("Starting rescan...")
+// rescanBatch processes up to rescanBatch messages after *last in a single
+// transaction, and advances *last and RescanState past them.
+//
+// Decoding JSON is most of the cost of processing a message, so it's spread
+// over concurrency goroutines, while the messages are handled in order by the
+// calling goroutine. Processing them out of order would change which message
+// first introduced a tweet or user, and could apply deletions before the
+// tweets they refer to.
+func (c *Covfefe) rescanBatch(conn *sqlite.Conn, last *int64, concurrency int,
+	pb *progressbar.ProgressBar) (n int, err error) {
+	defer sqliteutil.Save(conn)(&err)
 
-	count, err := sqliteutil.ResultInt64(conn.Prep("SELECT COUNT(*) FROM Messages;"))
+	var batch []*Message
+	if err := sqliteutil.Exec(conn,
+		"SELECT id, json, account, compressed FROM Messages WHERE id > ? ORDER BY id LIMIT ?;",
+		func(stmt *sqlite.Stmt) error {
+			m, err := storedMessage(stmt)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, m)
+			return nil
+		}, *last, rescanBatch); err != nil {
+		return 0, errors.Wrap(err, "listing Messages failed")
+	}
+
+	jobs := make(chan int)
+	decoded := make([]chan struct{}, len(batch))
+	for i := range decoded {
+		decoded[i] = make(chan struct{})
+	}
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for i := range jobs {
+				batch[i].decode(c.decoder)
+				close(decoded[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range batch {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for i, m := range batch {
+		<-decoded[i]
+		c.Handle(m)
+		*last = m.id
+		pb.Add(1)
+	}
+
+	c.log.WithField("message", *last).Debug("Rescan checkpoint")
+	if err := sqliteutil.Exec(conn, "UPDATE RescanState SET last_message = ?;",
+		nil, *last); err != nil {
+		return 0, errors.Wrap(err, "failed to save rescan state")
+	}
+	return len(batch), nil
+}
+
+// storedMessage builds a Message from a row with the id, json, account and
+// compressed columns of Messages.
+func storedMessage(stmt *sqlite.Stmt) (*Message, error) {
+	m := &Message{id: stmt.GetInt64("id")}
+	msg, err := storedJSON(stmt.GetReader("json"), stmt.GetInt64("compressed") != 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid message %d", m.id)
+	}
+	m.msg = msg
+	accounts, err := fastjson.Parse(stmt.GetText("account"))
 	if err != nil {
-		return errors.Wrap(err, "failed to count messages")
+		return nil, errors.Wrapf(err, "invalid account of message %d", m.id)
+	}
+	for _, a := range accounts.GetArray() {
+		m.observers = append(m.observers, a.GetInt64())
 	}
-	pb := progressbar.NewOptions64(count, progressbar.OptionShowCount())
+	return m, nil
+}
 
-	if err := sqliteutil.Exec(conn, "SELECT id, json FROM Messages;",
-		func(stmt *sqlite.Stmt) error {
-			c.Handle(&Message{
-				id:  stmt.GetInt64("id"),
-				msg: []byte(stmt.GetText("json")),
-			})
-			pb.Add(1)
+// streamBatch is how many messages StreamRawMessages loads at a time.
+const streamBatch = 1000
+
+// StreamRawMessages calls fn with each stored message with an ID greater than
+// since, in ID order, so passing the last ID seen resumes a previous run. The
+// account only has the ID set, and is the first of the accounts that received
+// the message, or nil if none was recorded. msg is decompressed if needed.
+//
+// If fn returns an error, StreamRawMessages stops and returns it. No database
+// connection is held while fn runs, so it can use the Covfefe.
+func (c *Covfefe) StreamRawMessages(since int64, fn func(id int64, account *twitter.User, msg []byte) error) error {
+	for {
+		var batch []*Message
+		err := c.withConn(func(conn *sqlite.Conn) error {
+			return sqliteutil.Exec(conn,
+				"SELECT id, json, account, compressed FROM Messages WHERE id > ? ORDER BY id LIMIT ?;",
+				func(stmt *sqlite.Stmt) error {
+					m, err := storedMessage(stmt)
+					if err != nil {
+						return err
+					}
+					batch = append(batch, m)
+					return nil
+				}, since, streamBatch)
+		})
+		if err != nil {
+			return errors.Wrap(err, "listing Messages failed")
+		}
+		for _, m := range batch {
+			var account *twitter.User
+			if len(m.observers) > 0 {
+				account = &twitter.User{ID: m.observers[0], IDStr: strconv.FormatInt(m.observers[0], 10)}
+			}
+			if err := fn(m.id, account, m.msg); err != nil {
+				return err
+			}
+			since = m.id
+		}
+		if len(batch) < streamBatch {
 			return nil
-		}); err != nil {
-		return errors.Wrap(err, "listing Messages failed")
+		}
 	}
+}
 
-	fmt.Fprintf(os.Stderr, "\n")
-	log.Info("Finishing up...")
-	return nil
+// Reprocess runs Handle again on the stored message with the given ID, for
+// example to check a processing fix against the message that triggered a bug.
+// Rows that were already derived from it are not replaced, so it's safe to
+// call repeatedly. Like during a rescan, nothing is downloaded or crawled, and
+// Reprocess must not be called while Run is running.
+func (c *Covfefe) Reprocess(messageID int64) error {
+	var m *Message
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, "SELECT id, json, account, compressed FROM Messages WHERE id = ?;",
+			func(stmt *sqlite.Stmt) (err error) {
+				m, err = storedMessage(stmt)
+				return err
+			}, messageID)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to load message")
+	}
+	if m == nil {
+		return errors.Errorf("message %d not found", messageID)
+	}
+
+	rescan := c.rescan
+	c.rescan = true
+	defer func() { c.rescan = rescan }()
+	return c.Handle(m)
 }
@@ -0,0 +1,80 @@
+package covfefe
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+)
+
+// fullText returns the complete text of a tweet, which is only in the extended
+// tweet if the text is longer than 140 characters, in which case Text is
+// truncated. The REST API with tweet_mode=extended sets FullText instead.
+func fullText(tweet *twitter.Tweet) string {
+	if tweet.ExtendedTweet != nil && tweet.ExtendedTweet.FullText != "" {
+		return tweet.ExtendedTweet.FullText
+	}
+	if tweet.FullText != "" {
+		return tweet.FullText
+	}
+	return tweet.Text
+}
+
+// SearchResult is a tweet matching a SearchTweets query.
+type SearchResult struct {
+	ID int64
+
+	// Snippet is an excerpt of the tweet text around the match, with matched
+	// terms surrounded by square brackets.
+	Snippet string
+}
+
+// SearchTweets returns up to limit tweets whose text matches query, best
+// matches first. The query uses the SQLite FTS5 syntax, see
+// https://www.sqlite.org/fts5.html#full_text_query_syntax. Deleted tweets are
+// not returned.
+func (c *Covfefe) SearchTweets(query string, limit int) ([]SearchResult, error) {
+	var res []SearchResult
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT rowid, snippet(TweetsText, 0, '[', ']', '…', 16)
+			FROM TweetsText WHERE TweetsText MATCH ? ORDER BY rank LIMIT ?;`,
+			func(stmt *sqlite.Stmt) error {
+				res = append(res, SearchResult{
+					ID:      stmt.ColumnInt64(0),
+					Snippet: stmt.ColumnText(1),
+				})
+				return nil
+			}, query, limit)
+	})
+	return res, errors.Wrap(err, "failed search query")
+}
+
+// TweetsByLang returns the IDs of up to limit archived tweets in the given
+// language, in ID order. lang is a BCP 47 code as detected by Twitter, or "und"
+// for tweets whose language could not be determined.
+func (c *Covfefe) TweetsByLang(lang string, limit int) ([]int64, error) {
+	var ids []int64
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT id FROM Tweets WHERE lang = ? ORDER BY id LIMIT ?;`,
+			func(stmt *sqlite.Stmt) error {
+				ids = append(ids, stmt.ColumnInt64(0))
+				return nil
+			}, lang, limit)
+	})
+	return ids, errors.Wrap(err, "failed select query")
+}
+
+// ThreadTweets returns the IDs of the archived tweets in the thread started by
+// the tweet conversationID, including it, in ID order. Replies archived from
+// payloads without a conversation ID are not included.
+func (c *Covfefe) ThreadTweets(conversationID int64) ([]int64, error) {
+	var ids []int64
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT id FROM Tweets WHERE conversation = ? ORDER BY id;`,
+			func(stmt *sqlite.Stmt) error {
+				ids = append(ids, stmt.ColumnInt64(0))
+				return nil
+			}, conversationID)
+	})
+	return ids, errors.Wrap(err, "failed select query")
+}
@@ -0,0 +1,150 @@
+package covfefe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveStats is a summary of the contents of the archive, see Stats.
+type ArchiveStats struct {
+	Tweets  int64
+	Users   int64
+	Follows int64
+
+	// MediaFiles is the number of distinct stored files, which can be less
+	// than the number of archived media because of deduplication.
+	MediaFiles int64
+
+	// MediaBytes is the total size of the stored media files, or -1 if the
+	// MediaStore can't report it.
+	MediaBytes int64
+
+	// Undelivered is the total number of tweets the streaming API reported
+	// as not delivered because of rate limits.
+	Undelivered int64
+
+	// FirstTweet and LastTweet are the creation times of the oldest and
+	// newest archived tweets, or zero if there are none.
+	FirstTweet, LastTweet time.Time
+
+	// DroppedProtected is the number of messages dropped as protected since
+	// the archive was opened, by reason, like "protected_user". It's not
+	// stored in the database.
+	DroppedProtected map[string]uint64
+}
+
+// mediaSizer is implemented by a MediaStore that can report the total size of
+// the files it stores.
+type mediaSizer interface {
+	Size() (int64, error)
+}
+
+// Size returns the total size of the files in s.Dir.
+func (s *FileStore) Size() (int64, error) {
+	var total int64
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, errors.WithStack(err)
+}
+
+// Stats computes a summary of the archive from the database, and from the
+// MediaStore if it supports it.
+func (c *Covfefe) Stats() (ArchiveStats, error) {
+	s := ArchiveStats{MediaBytes: -1, DroppedProtected: c.metrics.droppedProtected.snapshot()}
+	var first, last string
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT
+			(SELECT COUNT(*) FROM Tweets),
+			(SELECT COUNT(DISTINCT id) FROM Users),
+			(SELECT COUNT(*) FROM Follows),
+			(SELECT COUNT(DISTINCT name) FROM Media),
+			(SELECT MIN(created) FROM Tweets),
+			(SELECT MAX(created) FROM Tweets),
+			-- Limit notices count from the start of each connection, so
+			-- a drop means a new connection.
+			(SELECT TOTAL(CASE WHEN prev IS NULL OR track < prev THEN track
+				ELSE track - prev END) FROM (SELECT track,
+				LAG(track) OVER (ORDER BY message) AS prev FROM StreamLimits));`,
+			func(stmt *sqlite.Stmt) error {
+				s.Tweets = stmt.ColumnInt64(0)
+				s.Users = stmt.ColumnInt64(1)
+				s.Follows = stmt.ColumnInt64(2)
+				s.MediaFiles = stmt.ColumnInt64(3)
+				first, last = stmt.ColumnText(4), stmt.ColumnText(5)
+				s.Undelivered = stmt.ColumnInt64(6)
+				return nil
+			})
+	})
+	if err != nil {
+		return s, errors.Wrap(err, "failed stats query")
+	}
+	if s.FirstTweet, err = parseSQLTime(first); err != nil {
+		return s, err
+	}
+	if s.LastTweet, err = parseSQLTime(last); err != nil {
+		return s, err
+	}
+
+	if ms, ok := c.media.(mediaSizer); ok {
+		if s.MediaBytes, err = ms.Size(); err != nil {
+			return s, errors.Wrap(err, "failed to measure media store")
+		}
+	}
+	return s, nil
+}
+
+// logDroppedProtected logs every interval how many messages were dropped as
+// protected since the previous time, until ctx is done. Nothing is logged if
+// there were none.
+func (c *Covfefe) logDroppedProtected(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	last := c.metrics.droppedProtected.snapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		now := c.metrics.droppedProtected.snapshot()
+		fields := logrus.Fields{}
+		var total uint64
+		for reason, n := range now {
+			if d := n - last[reason]; d > 0 {
+				fields[reason] = d
+				total += d
+			}
+		}
+		last = now
+		if total > 0 {
+			fields["total"] = total
+			c.log.WithFields(fields).Info("Dropped protected messages")
+		}
+	}
+}
+
+// parseSQLTime parses a time stored in the Tweets table. The empty string
+// parses as the zero time.
+func parseSQLTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05 -0700 MST", v)
+	return t, errors.Wrapf(err, "invalid time %q", v)
+}
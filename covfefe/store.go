@@ -0,0 +1,373 @@
+package covfefe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A MediaStore persists downloaded media files. Implementations must be safe
+// for concurrent use.
+type MediaStore interface {
+	// Put stores the contents of r as the file name, which is relative to
+	// the root of the store and ends in the file extension.
+	Put(name string, r io.Reader) error
+}
+
+// A MediaProcessor transforms downloaded media before it's stored, for example
+// to re-encode or watermark it, see WithMediaProcessors. mediaType is the MIME
+// type detected from the contents. The returned bytes are stored instead of
+// data, and must still be a supported media format. Implementations must be
+// safe for concurrent use.
+type MediaProcessor interface {
+	Process(id int64, data []byte, mediaType string) ([]byte, error)
+}
+
+// MediaProcessorFunc adapts a function to the MediaProcessor interface.
+type MediaProcessorFunc func(id int64, data []byte, mediaType string) ([]byte, error)
+
+// Process calls f(id, data, mediaType).
+func (f MediaProcessorFunc) Process(id int64, data []byte, mediaType string) ([]byte, error) {
+	return f(id, data, mediaType)
+}
+
+// mediaName is the default name under which a media file is stored, see
+// WithMediaNamer.
+func mediaName(id int64, _ time.Time, ext string) string {
+	return fmt.Sprintf("%d.%s", id, ext)
+}
+
+// ShardedMediaName is a media namer for WithMediaNamer that stores files in two
+// levels of folders named after the first digits of the media ID, like
+// 123/456/1234567890.jpg. IDs grow over time, so files are grouped roughly by
+// when they were posted.
+func ShardedMediaName(id int64, ext string) string {
+	s := fmt.Sprintf("%06d", id)
+	return fmt.Sprintf("%s/%s/%d.%s", s[:3], s[3:6], id, ext)
+}
+
+// DatedMediaName is a media namer for WithDatedMediaNamer that stores files in
+// folders named after the year and month the tweet was posted, in UTC, like
+// 2019/07/1234567890.jpg, so that they can be pruned by age.
+func DatedMediaName(id int64, created time.Time, ext string) string {
+	return fmt.Sprintf("%s/%d.%s", created.UTC().Format("2006/01"), id, ext)
+}
+
+// snowflakeEpoch is the Unix time in milliseconds that the timestamps in
+// Twitter IDs count from.
+const snowflakeEpoch = 1288834974657
+
+// firstSnowflake is the lowest tweet ID that embeds a timestamp. Earlier IDs
+// were sequential.
+const firstSnowflake = 29700859247
+
+// snowflakeTime returns when the ID was generated, which for a tweet is when
+// it was posted, or the zero time if the ID predates timestamps.
+func snowflakeTime(id int64) time.Time {
+	if id < firstSnowflake {
+		return time.Time{}
+	}
+	ms := id>>22 + snowflakeEpoch
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC()
+}
+
+// mediaTime returns when the tweet with media id was posted, from the tweet
+// ID, or else from the media ID, which is uploaded around the same time.
+func mediaTime(tweet, id int64) time.Time {
+	if t := snowflakeTime(tweet); !t.IsZero() {
+		return t
+	}
+	return snowflakeTime(id)
+}
+
+// mediaDeleter is implemented by a MediaStore that can remove files, which is
+// required by WithPurgeMediaOnDeletion.
+type mediaDeleter interface {
+	// Delete removes the file name. Removing a missing file is not an error.
+	Delete(name string) error
+}
+
+// mediaOpener is implemented by a MediaStore that can read back files, which
+// is required to check them with Verify.
+type mediaOpener interface {
+	// Open returns the contents of the file name. If it doesn't exist, the
+	// error satisfies os.IsNotExist.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// tempCleaner is implemented by a MediaStore that can leave temporary files
+// behind when interrupted. Open calls CleanTemp to remove them.
+type tempCleaner interface {
+	CleanTemp() (removed int, err error)
+}
+
+// upgradedName is the name under which a larger copy of the file stored as
+// name is stored.
+func upgradedName(name, hash, ext string) string {
+	return fmt.Sprintf("%s-%s.%s", strings.TrimSuffix(name, "."+ext), hash[:16], ext)
+}
+
+// FileStore is a MediaStore that writes files to a local directory.
+type FileStore struct {
+	Dir string
+
+	// Overwrite decides what happens when a file already exists, for
+	// example left incomplete by a crash. The default is SkipExisting.
+	Overwrite OverwritePolicy
+}
+
+// An OverwritePolicy decides whether FileStore.Put replaces existing files.
+type OverwritePolicy int
+
+const (
+	// SkipExisting keeps existing files, and discards the new contents.
+	SkipExisting OverwritePolicy = iota
+	// OverwriteExisting always replaces existing files.
+	OverwriteExisting
+	// OverwriteSmaller replaces existing files that are smaller than the
+	// new contents, like those left incomplete by a crash.
+	OverwriteSmaller
+)
+
+// Put writes r to a temporary file first, and moves it into place only once
+// it's complete, so that a failure doesn't leave a partial file behind.
+func (s *FileStore) Put(name string, r io.Reader) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name()) // fails harmlessly after the rename
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return errors.WithStack(err)
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.WithStack(err)
+	case s.Overwrite == OverwriteExisting:
+	case s.Overwrite == OverwriteSmaller && info.Size() < size:
+	default:
+		return nil
+	}
+	return errors.WithStack(os.Rename(f.Name(), path))
+}
+
+// staleTempAge is how old a temporary file must be for CleanTemp to consider
+// it abandoned, rather than in use by another process.
+const staleTempAge = time.Hour
+
+// CleanTemp removes the temporary files left behind by Put calls that were
+// interrupted, for example by a crash.
+func (s *FileStore) CleanTemp() (removed int, err error) {
+	err = filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == s.Dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".tmp") ||
+			time.Since(info.ModTime()) < staleTempAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, errors.WithStack(err)
+}
+
+func (s *FileStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+func (s *FileStore) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	return f, errors.WithStack(err)
+}
+
+// S3Store is a MediaStore that uploads files to an Amazon S3 bucket, under the
+// given key prefix. Requests are signed with AWS Signature Version 4.
+type S3Store struct {
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// SessionToken is the token of temporary credentials, like those of an
+	// assumed role, sent as X-Amz-Security-Token. It's empty for long term
+	// access keys.
+	SessionToken string
+
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (s *S3Store) Put(name string, r io.Reader) error {
+	// The whole payload is needed in memory anyway, to hash it for signing.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	res, err := s.request("PUT", name, data)
+	if err != nil {
+		return errors.Wrapf(err, "error uploading %s", name)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("error uploading %s: %s: %s", res.Request.URL, res.Status, body)
+	}
+	return nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	res, err := s.request("DELETE", name, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting %s", name)
+	}
+	defer res.Body.Close()
+	// S3 responds 204 No Content also if the object didn't exist.
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("error deleting %s: %s: %s", res.Request.URL, res.Status, body)
+	}
+	return nil
+}
+
+// request makes a signed request for the object name with the given body,
+// whose Content-Type is guessed from the extension of name.
+func (s *S3Store) request(method, name string, body []byte) (*http.Response, error) {
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", s.Bucket, s.Region)
+	u := &url.URL{Scheme: "https", Host: host, Path: "/" + path.Join(s.Prefix, name)}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" && body != nil {
+		req.Header.Set("Content-Type", t)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	return res, errors.WithStack(err)
+}
+
+func (s *S3Store) Open(name string) (io.ReadCloser, error) {
+	res, err := s.request("GET", name, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error downloading %s", name)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	default:
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, errors.Errorf("error downloading %s: %s: %s", res.Request.URL, res.Status, body)
+	}
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, which
+// covers the host and all the headers already set on req.
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (s *S3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
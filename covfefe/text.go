@@ -0,0 +1,101 @@
+package covfefe
+
+import (
+	"unicode/utf8"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// An offsetUnit is what offsets into the text of a tweet count. Go strings are
+// indexed by byte, so slicing them with either corrupts multibyte text.
+type offsetUnit int
+
+const (
+	// codePoints is what the entity indices and display_text_range of the
+	// v1.1 API count, so an emoji is one unit regardless of its encoding.
+	codePoints offsetUnit = iota
+
+	// utf16Units is what string offsets count in JavaScript and Java, and
+	// so in some third-party archives. Characters outside the Basic
+	// Multilingual Plane, like most emoji, are two units.
+	utf16Units
+)
+
+// width returns how many units r counts as.
+func (u offsetUnit) width(r rune) int {
+	if u == utf16Units && r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// byteOffset returns the byte index in s of the offset off, counted in unit.
+// An offset in the middle of a character is rounded up to the next one, and
+// offsets past the end of s return len(s). Invalid UTF-8 bytes count as one
+// unit each, like the U+FFFD they decode to.
+func byteOffset(s string, off int, unit offsetUnit) int {
+	n := 0
+	for i, r := range s {
+		if n >= off {
+			return i
+		}
+		n += unit.width(r)
+	}
+	return len(s)
+}
+
+// unitOffset returns the offset, counted in unit, of the byte index i in s.
+// It's the inverse of byteOffset for indices at character boundaries.
+func unitOffset(s string, i int, unit offsetUnit) int {
+	if i > len(s) {
+		i = len(s)
+	}
+	n := 0
+	for _, r := range s[:i] {
+		n += unit.width(r)
+	}
+	return n
+}
+
+// runeOffset returns the index in the runes of s of the byte index i.
+func runeOffset(s string, i int) int {
+	if i > len(s) {
+		i = len(s)
+	}
+	return utf8.RuneCountInString(s[:i])
+}
+
+// entityText returns the part of text covered by the indices of an entity,
+// counted in unit, or the empty string if they are out of order.
+func entityText(text string, indices twitter.Indices, unit offsetUnit) string {
+	start := byteOffset(text, indices.Start(), unit)
+	end := byteOffset(text, indices.End(), unit)
+	if start > end {
+		return ""
+	}
+	return text[start:end]
+}
+
+// displayTextRange returns the display_text_range of tweet, matching the text
+// returned by fullText, clamped to the length of text. It returns false if the
+// range is missing, which go-twitter decodes as [0, 0], or out of order.
+func displayTextRange(tweet *twitter.Tweet, text string) (twitter.Indices, bool) {
+	r := tweet.DisplayTextRange
+	if tweet.ExtendedTweet != nil && tweet.ExtendedTweet.FullText != "" {
+		r = tweet.ExtendedTweet.DisplayTextRange
+	}
+	if r == (twitter.Indices{}) || r.Start() > r.End() {
+		return r, false
+	}
+	n := unitOffset(text, len(text), codePoints)
+	if r[0] < 0 {
+		r[0] = 0
+	}
+	if r[1] > n {
+		r[1] = n
+	}
+	if r[0] > r[1] {
+		r[0] = r[1]
+	}
+	return r, true
+}
@@ -13,14 +13,35 @@ import (
 	"github.com/valyala/fastjson"
 )
 
+// An apiError is a non-200 response of the REST API.
+type apiError struct {
+	url     string
+	status  int
+	message string // the first error in the body, if any
+}
+
+func (e *apiError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("error getting %s: %s", e.url, e.message)
+	}
+	return fmt.Sprintf("error getting %s: %d %s", e.url, e.status, http.StatusText(e.status))
+}
+
 func getJSON(ctx context.Context, c *http.Client, url string, v interface{}) error {
+	_, err := getJSONHeader(ctx, c, url, v)
+	return err
+}
+
+// getJSONHeader is getJSON, but also returns the response headers, even if the
+// request failed with an *apiError.
+func getJSONHeader(ctx context.Context, c *http.Client, url string, v interface{}) (http.Header, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	r, err := c.Do(req.WithContext(ctx))
 	if err != nil {
-		return errors.Wrapf(err, "error getting %s", url)
+		return nil, errors.Wrapf(err, "error getting %s", url)
 	}
 	defer r.Body.Close()
 
@@ -31,16 +52,21 @@ func getJSON(ctx context.Context, c *http.Client, url string, v interface{}) err
 			}
 		}
 		json.NewDecoder(r.Body).Decode(&errs)
-		for _, e := range errs.Errors {
-			return errors.Errorf("error getting %s: %s", url, e.Message)
+		e := &apiError{url: url, status: r.StatusCode}
+		if len(errs.Errors) > 0 {
+			e.message = errs.Errors[0].Message
 		}
-		return errors.Errorf("error getting %s: %s", url, r.Status)
+		return r.Header, errors.WithStack(e)
 	}
 
-	return errors.Wrapf(json.NewDecoder(r.Body).Decode(v),
+	return r.Header, errors.Wrapf(json.NewDecoder(r.Body).Decode(v),
 		"error reading and decoding %q", url)
 }
 
+// extraParams are query parameters that make the REST API include media alt
+// text and, undocumented, card objects in tweets, which carry polls.
+const extraParams = "include_ext_alt_text=true&include_cards=1&cards_platform=iPhone-13"
+
 func verifyCredentials(ctx context.Context, c *http.Client) (*twitter.User, error) {
 	url := "https://api.twitter.com/1.1/account/verify_credentials.json?skip_status=true"
 	var u *twitter.User
@@ -55,10 +81,11 @@ type timelineMonitor struct {
 	c   *http.Client
 	m   chan *Message
 	u   *twitter.User
+	log logrus.FieldLogger
 }
 
 func (t *timelineMonitor) followTimeline() error {
-	log := logrus.WithField("account", t.u.ScreenName)
+	log := t.log.WithField("account", t.u.ScreenName)
 
 	tick := time.NewTicker(1*time.Minute + 5*time.Second)
 	defer tick.Stop()
@@ -71,7 +98,7 @@ func (t *timelineMonitor) followTimeline() error {
 		case <-tick.C:
 		}
 
-		url := "https://api.twitter.com/1.1/statuses/home_timeline.json?count=200"
+		url := "https://api.twitter.com/1.1/statuses/home_timeline.json?count=200&" + extraParams
 		if sinceID != 0 { // Twitter hates devs.
 			url = fmt.Sprintf("%s&since_id=%d", url, sinceID)
 		}
@@ -83,7 +110,11 @@ func (t *timelineMonitor) followTimeline() error {
 		log.WithField("tweets", len(tweets)).Debug("Fetched home timeline")
 
 		for _, tweet := range tweets {
-			t.m <- &Message{account: t.u, msg: tweet}
+			select {
+			case t.m <- &Message{account: t.u, msg: tweet}:
+			case <-t.ctx.Done():
+				return t.ctx.Err()
+			}
 		}
 
 		if len(tweets) > 0 {
@@ -106,6 +137,93 @@ func (t *timelineMonitor) followTimeline() error {
 	}
 }
 
+// rawTweet returns the JSON object of the tweet with the given ID in the
+// message, looking into retweeted, quoted and event target tweets. It's used to
+// access fields that the go-twitter types don't decode, like cards.
+func (m *Message) rawTweet(id int64) *fastjson.Value {
+	return findTweet(m.raw(), id)
+}
+
+// raw returns the parsed message, or nil if it's not valid JSON.
+func (m *Message) raw() *fastjson.Value {
+	if m.parsed == nil {
+		v, err := fastjson.ParseBytes(m.msg)
+		if err != nil {
+			return nil
+		}
+		m.parsed = v
+	}
+	return m.parsed
+}
+
+// A Decoder turns a raw message into the go-twitter type that Handle processes,
+// like *twitter.Tweet, *twitter.Event or *twitter.StatusDeletion. It returns
+// nil if it doesn't recognize the message.
+type Decoder interface {
+	Decode(msg []byte) interface{}
+}
+
+// DecoderFunc adapts a function to the Decoder interface.
+type DecoderFunc func(msg []byte) interface{}
+
+// Decode calls f(msg).
+func (f DecoderFunc) Decode(msg []byte) interface{} { return f(msg) }
+
+// StreamDecoder is the default Decoder, which understands the messages of the
+// streaming and REST APIs. Custom decoders can fall back to it.
+var StreamDecoder Decoder = DecoderFunc(getMessage)
+
+// decode returns the go-twitter type of the message according to d, and parses
+// it for rawTweet. Both are cached, so decode can be called ahead of Handle,
+// even on a different goroutine.
+func (m *Message) decode(d Decoder) interface{} {
+	if m.decoded == nil {
+		m.decoded = d.Decode(m.msg)
+	}
+	if m.parsed == nil {
+		m.parsed, _ = fastjson.ParseBytes(m.msg)
+	}
+	return m.decoded
+}
+
+// rawUser returns the JSON object of the user with the given ID in the
+// message, looking into the authors of tweets and the sources and targets of
+// events, like rawTweet.
+func (m *Message) rawUser(id int64) *fastjson.Value {
+	return findUser(m.raw(), id)
+}
+
+func findUser(v *fastjson.Value, id int64) *fastjson.Value {
+	if v == nil || v.Type() != fastjson.TypeObject {
+		return nil
+	}
+	if v.Exists("screen_name") && v.GetInt64("id") == id {
+		return v
+	}
+	for _, key := range []string{"user", "source", "target",
+		"retweeted_status", "quoted_status", "target_object"} {
+		if u := findUser(v.Get(key), id); u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func findTweet(v *fastjson.Value, id int64) *fastjson.Value {
+	if v == nil || v.Type() != fastjson.TypeObject {
+		return nil
+	}
+	if v.Exists("retweet_count") && v.GetInt64("id") == id {
+		return v
+	}
+	for _, key := range []string{"retweeted_status", "quoted_status", "target_object"} {
+		if t := findTweet(v.Get(key), id); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
 func getMessage(message []byte) interface{} {
 	v := fastjson.MustParseBytes(message)
 
@@ -136,6 +254,15 @@ func getMessage(message []byte) interface{} {
 	case v.Exists("user_withheld"):
 		res = new(twitter.UserWithheld)
 		message = v.Get("user_withheld").MarshalTo(nil)
+	case v.Exists("limit"):
+		res = new(twitter.StreamLimit)
+		message = v.Get("limit").MarshalTo(nil)
+	case v.Exists("scrub_geo"):
+		res = new(twitter.LocationDeletion)
+		message = v.Get("scrub_geo").MarshalTo(nil)
+	case v.Exists("direct_message"):
+		res = new(twitter.DirectMessage)
+		message = v.Get("direct_message").MarshalTo(nil)
 	case v.Exists("event"):
 		res = new(twitter.Event)
 	default:
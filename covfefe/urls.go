@@ -0,0 +1,130 @@
+package covfefe
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+)
+
+// entities returns the most complete Entities of tweet, preferring the ones
+// of the extended tweet, since the others are truncated along with the text.
+func entities(tweet *twitter.Tweet) *twitter.Entities {
+	if tweet.ExtendedTweet != nil && tweet.ExtendedTweet.Entities != nil {
+		return tweet.ExtendedTweet.Entities
+	}
+	return tweet.Entities
+}
+
+func (c *Covfefe) processURLs(m *Message, tweet *twitter.Tweet) (err error) {
+	e := entities(tweet)
+	if e == nil {
+		return nil
+	}
+	var toResolve []string
+	seen := make(map[string]bool)
+	for _, u := range e.Urls {
+		if seen[u.URL] {
+			continue
+		}
+		seen[u.URL] = true
+		if uerr := c.insertURL(tweet.ID, u.URL, u.ExpandedURL, m); uerr != nil {
+			c.log.WithError(uerr).WithField("message", m.id).Error("Failed to insert URL")
+			err = firstError(err, uerr)
+			continue
+		}
+		if u.ExpandedURL != "" {
+			toResolve = append(toResolve, u.ExpandedURL)
+		}
+	}
+
+	if len(toResolve) != 0 && c.resolveURLs && c.fetching() {
+		c.inBackground(m, func() {
+			for _, u := range toResolve {
+				c.resolveURL(u)
+			}
+		})
+	}
+	return err
+}
+
+// resolveURL follows the redirects of an expanded URL and records the final
+// destination and status, unless it was already resolved.
+func (c *Covfefe) resolveURL(url string) {
+	log := c.log.WithField("url", url)
+	resolved, err := c.urlResolved(url)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up URL")
+		return
+	}
+	if resolved {
+		return
+	}
+	final, status, err := c.httpResolve(url)
+	if err != nil {
+		log.WithError(err).Warning("Failed to resolve URL")
+		return
+	}
+	log.WithField("final", final).WithField("status", status).Debug("Resolved URL")
+	if err := c.insertResolvedURL(url, final, status); err != nil {
+		log.WithError(err).Error("Failed to insert resolved URL")
+		return
+	}
+	if c.wayback != nil && status < 400 {
+		c.archiveURL(url, final)
+	}
+}
+
+// waybackSave is the Save Page Now endpoint of the Internet Archive.
+const waybackSave = "https://web.archive.org/save/"
+
+// archiveURL submits final, the destination of the expanded URL url, to the
+// Wayback Machine, and records the snapshot it was saved as.
+func (c *Covfefe) archiveURL(url, final string) {
+	log := c.log.WithField("url", url).WithField("final", final)
+	if err := c.wayback.wait(c.ctx, "web.archive.org"); err != nil {
+		return
+	}
+	res, err := c.httpDo(c.ctx, "GET", waybackSave+final)
+	if err != nil {
+		log.WithError(err).Warning("Failed to submit URL to the Wayback Machine")
+		return
+	}
+	res.Body.Close()
+	snapshot := waybackSnapshot(res)
+	if res.StatusCode != http.StatusOK || snapshot == "" {
+		log.WithField("status", res.StatusCode).Warning("The Wayback Machine didn't save URL")
+		return
+	}
+	log.WithField("wayback", snapshot).Debug("Archived URL")
+	if err := c.insertWaybackURL(url, snapshot); err != nil {
+		log.WithError(err).Error("Failed to insert Wayback Machine URL")
+	}
+}
+
+// waybackSnapshot returns the URL of the snapshot made by a Save Page Now
+// request, from the Content-Location header or the final redirect, or "" if
+// there is none.
+func waybackSnapshot(res *http.Response) string {
+	if loc := res.Header.Get("Content-Location"); strings.HasPrefix(loc, "/web/") {
+		return "https://web.archive.org" + loc
+	}
+	if u := res.Request.URL; u.Host == "web.archive.org" && strings.HasPrefix(u.Path, "/web/") {
+		return u.String()
+	}
+	return ""
+}
+
+func (c *Covfefe) httpResolve(url string) (final string, status int, err error) {
+	res, err := c.httpDo(c.ctx, "HEAD", url)
+	if err == nil && res.StatusCode == http.StatusMethodNotAllowed {
+		res.Body.Close()
+		res, err = c.httpDo(c.ctx, "GET", url)
+	}
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	res.Body.Close()
+	return res.Request.URL.String(), res.StatusCode, nil
+}
@@ -0,0 +1,129 @@
+package covfefe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqliteutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fastjson"
+)
+
+// VerifyReport lists the problems found by Verify.
+type VerifyReport struct {
+	// MediaChecked is the number of stored files that were checked, which
+	// is zero if the MediaStore can't read back files.
+	MediaChecked int
+
+	// MissingMedia are the names of the files recorded in Media,
+	// ProfileImages or CardImages that are not in the MediaStore.
+	MissingMedia []string
+
+	// CorruptMedia are the names of the stored files whose contents don't
+	// match the hash they were recorded with.
+	CorruptMedia []string
+
+	// TweetsChecked is the number of tweets whose raw message was checked.
+	TweetsChecked int
+
+	// BrokenTweets are the IDs of the tweets whose raw message can't be
+	// parsed, or doesn't contain the tweet.
+	BrokenTweets []int64
+}
+
+// OK returns whether Verify found no problems.
+func (r VerifyReport) OK() bool {
+	return len(r.MissingMedia) == 0 && len(r.CorruptMedia) == 0 && len(r.BrokenTweets) == 0
+}
+
+// Verify checks the integrity of the archive. Every stored file is read back
+// from the MediaStore, if it supports it, and compared with its recorded hash.
+// Then the raw message of every tweet is parsed again. Problems are reported
+// in the VerifyReport, while the error is for failures to run the checks.
+func (c *Covfefe) Verify() (VerifyReport, error) {
+	var r VerifyReport
+	if err := c.verifyMedia(&r); err != nil {
+		return r, err
+	}
+	err := c.verifyTweets(&r)
+	return r, err
+}
+
+func (c *Covfefe) verifyMedia(r *VerifyReport) error {
+	mo, ok := c.media.(mediaOpener)
+	if !ok {
+		c.log.Warning("The media store can't read back files, skipping media")
+		return nil
+	}
+
+	// Collect the files first, not to keep a connection busy for as long as
+	// reading them takes.
+	type storedFile struct{ name, hash string }
+	var files []storedFile
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT name, hash FROM Media
+			UNION SELECT name, hash FROM ProfileImages
+			UNION SELECT name, hash FROM CardImages ORDER BY name;`,
+			func(stmt *sqlite.Stmt) error {
+				files = append(files, storedFile{stmt.ColumnText(0), stmt.ColumnText(1)})
+				return nil
+			})
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list media")
+	}
+
+	for _, f := range files {
+		log := c.log.WithFields(logrus.Fields{"name": f.name, "hash": f.hash})
+		rc, err := mo.Open(f.name)
+		if os.IsNotExist(err) {
+			log.Warning("Missing media file")
+			r.MissingMedia = append(r.MissingMedia, f.name)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s", f.name)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", f.name)
+		}
+		r.MediaChecked++
+		if hex.EncodeToString(h.Sum(nil)) != f.hash {
+			log.Warning("Corrupt media file")
+			r.CorruptMedia = append(r.CorruptMedia, f.name)
+		}
+	}
+	return nil
+}
+
+func (c *Covfefe) verifyTweets(r *VerifyReport) error {
+	var p fastjson.Parser
+	err := c.withConn(func(conn *sqlite.Conn) error {
+		return sqliteutil.Exec(conn, `SELECT Tweets.id, Messages.json, Messages.compressed FROM Tweets
+			JOIN Messages ON Tweets.message = Messages.id ORDER BY Tweets.id;`,
+			func(stmt *sqlite.Stmt) error {
+				id := stmt.ColumnInt64(0)
+				r.TweetsChecked++
+				msg, err := storedJSON(stmt.ColumnReader(1), stmt.ColumnInt64(2) != 0)
+				if err == nil {
+					var v *fastjson.Value
+					if v, err = p.ParseBytes(msg); err == nil && findTweet(v, id) == nil {
+						err = errors.New("tweet not found in its message")
+					}
+				}
+				if err != nil {
+					c.log.WithError(err).WithField("tweet", id).Warning("Broken tweet message")
+					r.BrokenTweets = append(r.BrokenTweets, id)
+				}
+				return nil
+			})
+	})
+	return errors.Wrap(err, "failed to check tweets")
+}
@@ -0,0 +1,162 @@
+package covfefe
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/pkg/errors"
+	"github.com/valyala/fastjson"
+)
+
+// HandleWebhook handles a payload of the Account Activity API, as delivered by
+// a webhook subscribed to account. The events in it are translated to the
+// format of the streaming API, which is what gets stored in Messages, and
+// passed to Handle in order. Events that have no streaming equivalent, like
+// direct_message_events, are logged and skipped. Failures are logged as they
+// happen, and the first one is returned.
+func (c *Covfefe) HandleWebhook(body []byte, account *twitter.User) error {
+	v, err := fastjson.ParseBytes(body)
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook payload")
+	}
+	payload, err := v.Object()
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook payload")
+	}
+
+	var a fastjson.Arena
+	var msgs [][]byte
+	payload.Visit(func(key []byte, v *fastjson.Value) {
+		var translate func(a *fastjson.Arena, e *fastjson.Value) *fastjson.Value
+		switch string(key) {
+		case "for_user_id", "user_has_blocked":
+			return
+		case "tweet_create_events":
+			translate = func(_ *fastjson.Arena, e *fastjson.Value) *fastjson.Value { return e }
+		case "favorite_events":
+			translate = webhookFavorite
+		case "follow_events", "block_events", "mute_events":
+			translate = webhookUserEvent
+		case "tweet_delete_events":
+			translate = webhookDeletion
+		default:
+			c.log.WithField("key", string(key)).Warning("Skipped unsupported webhook events")
+			return
+		}
+		for _, e := range v.GetArray() {
+			msg := translate(&a, e)
+			if msg == nil {
+				c.log.WithField("key", string(key)).Warning("Skipped malformed webhook event")
+				continue
+			}
+			msgs = append(msgs, msg.MarshalTo(nil))
+		}
+	})
+
+	for _, msg := range msgs {
+		err = firstError(err, c.Handle(&Message{account: account, msg: msg}))
+	}
+	return err
+}
+
+// webhookFavorite translates an item of favorite_events to a favorite event,
+// or returns nil if it's incomplete.
+func webhookFavorite(a *fastjson.Arena, e *fastjson.Value) *fastjson.Value {
+	if !e.Exists("user") || !e.Exists("favorited_status", "user") {
+		return nil
+	}
+	ev := a.NewObject()
+	ev.Set("event", a.NewString("favorite"))
+	ev.Set("created_at", a.NewString(webhookTime(e)))
+	ev.Set("source", e.Get("user"))
+	ev.Set("target", e.Get("favorited_status", "user"))
+	ev.Set("target_object", e.Get("favorited_status"))
+	return ev
+}
+
+// webhookUserEvent translates an item of follow_events, block_events or
+// mute_events to an event named after its type, like follow or unmute, or
+// returns nil if it's incomplete.
+func webhookUserEvent(a *fastjson.Arena, e *fastjson.Value) *fastjson.Value {
+	if e.GetStringBytes("type") == nil {
+		return nil
+	}
+	source, target := webhookUser(a, e.Get("source")), webhookUser(a, e.Get("target"))
+	if source == nil || target == nil {
+		return nil
+	}
+	ev := a.NewObject()
+	ev.Set("event", a.NewStringBytes(e.GetStringBytes("type")))
+	ev.Set("created_at", a.NewString(webhookTime(e)))
+	ev.Set("source", source)
+	ev.Set("target", target)
+	return ev
+}
+
+// webhookUser returns a copy of the user object u with a numeric id and an
+// id_str, or nil if it has no valid ID. The Account Activity API encodes the
+// IDs of the users of follow, block and mute events as strings.
+func webhookUser(a *fastjson.Arena, u *fastjson.Value) *fastjson.Value {
+	o, err := u.Object()
+	if err != nil {
+		return nil
+	}
+	id := webhookID(u.Get("id"))
+	if id == "0" {
+		return nil
+	}
+	user := a.NewObject()
+	o.Visit(func(key []byte, v *fastjson.Value) {
+		user.Set(string(key), v)
+	})
+	user.Set("id", a.NewNumberString(id))
+	user.Set("id_str", a.NewString(id))
+	return user
+}
+
+// webhookDeletion translates an item of tweet_delete_events to a deletion
+// notice, or returns nil if it's incomplete. The Account Activity API encodes
+// the IDs as strings.
+func webhookDeletion(a *fastjson.Arena, e *fastjson.Value) *fastjson.Value {
+	if !e.Exists("status", "id") || !e.Exists("status", "user_id") {
+		return nil
+	}
+	status := a.NewObject()
+	id, user := webhookID(e.Get("status", "id")), webhookID(e.Get("status", "user_id"))
+	status.Set("id", a.NewNumberString(id))
+	status.Set("id_str", a.NewString(id))
+	status.Set("user_id", a.NewNumberString(user))
+	status.Set("user_id_str", a.NewString(user))
+	notice := a.NewObject()
+	notice.Set("status", status)
+	if ts := e.Get("timestamp_ms"); ts != nil {
+		notice.Set("timestamp_ms", ts)
+	}
+	msg := a.NewObject()
+	msg.Set("delete", notice)
+	return msg
+}
+
+// webhookID returns the decimal form of an ID that might be a string or a
+// number, or "0" if it's missing or invalid.
+func webhookID(v *fastjson.Value) string {
+	if v != nil && v.Type() == fastjson.TypeString {
+		if _, err := strconv.ParseInt(string(v.GetStringBytes()), 10, 64); err == nil {
+			return string(v.GetStringBytes())
+		}
+		return "0"
+	}
+	return strconv.FormatInt(v.GetInt64(), 10)
+}
+
+// webhookTime returns the time of an event in the created_at format of the
+// streaming API. Some events have it already, others only have a timestamp in
+// milliseconds, as a string.
+func webhookTime(e *fastjson.Value) string {
+	if t := e.GetStringBytes("created_at"); t != nil {
+		return string(t)
+	}
+	ms, _ := strconv.ParseInt(string(e.GetStringBytes("created_timestamp")), 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RubyDate)
+}